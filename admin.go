@@ -0,0 +1,421 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/henrygd/social-image-server/internal/concurrency"
+	"github.com/henrygd/social-image-server/internal/config"
+	"github.com/henrygd/social-image-server/internal/database"
+	"github.com/henrygd/social-image-server/internal/jobs"
+	"github.com/henrygd/social-image-server/internal/screenshot"
+	"github.com/henrygd/social-image-server/internal/templates"
+	"github.com/henrygd/social-image-server/internal/warmup"
+)
+
+// cache entry returned by the admin api
+type cacheEntry struct {
+	Url        string `json:"url"`
+	CacheKey   string `json:"cache_key"`
+	File       string `json:"file"`
+	Size       int64  `json:"size"`
+	Date       string `json:"date"`
+	LastAccess string `json:"last_access"`
+}
+
+func newCacheEntry(img *database.Image) cacheEntry {
+	size := img.FileSize
+	if size == 0 {
+		// size is zero if file is missing
+		size, _ = img.Size()
+	}
+	return cacheEntry{
+		Url:        img.Url,
+		CacheKey:   img.CacheKey,
+		File:       img.File,
+		Size:       size,
+		Date:       img.Date,
+		LastAccess: img.LastAccess,
+	}
+}
+
+// adds admin endpoints to the router
+func addAdminRoutes(router *http.ServeMux) {
+	router.HandleFunc("GET /admin/cache", requireAdmin(handleListCache))
+	router.HandleFunc("DELETE /admin/cache", requireAdmin(handlePurgeCache))
+	router.HandleFunc("GET /admin/cache/entry", requireAdmin(handleGetCacheEntry))
+	router.HandleFunc("DELETE /admin/cache/entry", requireAdmin(handleDeleteCacheEntry))
+	router.HandleFunc("POST /admin/cache/regen", requireAdmin(handleRegenCacheEntry))
+	router.HandleFunc("GET /admin/warmup", requireAdmin(handleListWarmups))
+	router.HandleFunc("POST /admin/warmup", requireAdmin(handleStartWarmup))
+	router.HandleFunc("GET /admin/warmup/{id}", requireAdmin(handleGetWarmup))
+	router.HandleFunc("GET /admin/templates", requireAdmin(handleListTemplates))
+	router.HandleFunc("GET /admin/templates/{name}", requireAdmin(handleGetTemplate))
+	router.HandleFunc("GET /admin/templates/{name}/preview", requireAdmin(handlePreviewTemplate))
+	router.HandleFunc("PUT /admin/templates/{name}", requireAdmin(handlePutTemplate))
+	router.HandleFunc("DELETE /admin/templates/{name}", requireAdmin(handleDeleteTemplate))
+}
+
+// wraps a handler to require ADMIN_KEY as a bearer token, or as the basic
+// auth password for browsers. admin endpoints are disabled if ADMIN_KEY is not set.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminKey := config.Get().AdminKey
+		if adminKey == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			_, token, ok = r.BasicAuth()
+		}
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminKey)) != 1 {
+			if wantsHTML(r) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// lists cache entries. supports prefix, domain, limit and offset params.
+func handleListCache(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, err := intParam(query.Get("limit"), 50, 1, 500)
+	if err != nil {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+	offset, err := intParam(query.Get("offset"), 0, 0, -1)
+	if err != nil {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+	filter := database.ImageFilter{Prefix: query.Get("prefix"), Domain: query.Get("domain")}
+	images, total, err := database.ListImages(filter, limit, offset)
+	if err != nil {
+		handleServerError(w, err)
+		return
+	}
+	entries := make([]cacheEntry, len(images))
+	for i := range images {
+		entries[i] = newCacheEntry(&images[i])
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"total":   total,
+		"limit":   limit,
+		"offset":  offset,
+		"entries": entries,
+	})
+}
+
+// deletes cache entries by prefix or domain
+func handlePurgeCache(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := database.ImageFilter{Prefix: query.Get("prefix"), Domain: query.Get("domain")}
+	if filter.Prefix == "" && filter.Domain == "" {
+		http.Error(w, "prefix or domain required", http.StatusBadRequest)
+		return
+	}
+	deleted, err := database.DeleteImages(filter)
+	if err != nil {
+		handleServerError(w, err)
+		return
+	}
+	slog.Info("Purged cache", "prefix", filter.Prefix, "domain", filter.Domain, "count", deleted)
+	writeJSON(w, http.StatusOK, map[string]int{"deleted": deleted})
+}
+
+// returns details of a single cache entry
+func handleGetCacheEntry(w http.ResponseWriter, r *http.Request) {
+	img, err := database.GetImage(r.URL.Query().Get("url"))
+	if err != nil {
+		handleEntryError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newCacheEntry(img))
+}
+
+// deletes a single cache entry
+func handleDeleteCacheEntry(w http.ResponseWriter, r *http.Request) {
+	if err := database.DeleteImage(r.URL.Query().Get("url")); err != nil {
+		handleEntryError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// regenerates the image for a cache entry using its cache key
+func handleRegenCacheEntry(w http.ResponseWriter, r *http.Request) {
+	urlKey := r.URL.Query().Get("url")
+	mutex := concurrency.GetOrCreateUrlMutex(urlKey)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	img, err := database.GetImage(urlKey)
+	if err != nil {
+		handleEntryError(w, err)
+		return
+	}
+	reqData, err := reqDataFromCacheKey(img.CacheKey)
+	if err != nil {
+		http.Error(w, "Could not recreate request: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	slog.Debug("Regenerating cache entry", "url", urlKey)
+	if _, err := screenshot.Take(reqData); err != nil {
+		handleServerError(w, err)
+		return
+	}
+	if img, err = database.GetImage(urlKey); err != nil {
+		handleServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newCacheEntry(img))
+}
+
+// starts a background warm-up job for a sitemap
+func handleStartWarmup(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts := warmup.Options{Sitemap: query.Get("sitemap"), Host: publicHost()}
+	if opts.Sitemap == "" {
+		http.Error(w, "sitemap required", http.StatusBadRequest)
+		return
+	}
+	if u, err := url.Parse(opts.Sitemap); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		http.Error(w, "invalid sitemap url", http.StatusBadRequest)
+		return
+	}
+	// match og:image urls against the host used to reach the api if PUBLIC_URL is not set
+	if opts.Host == "" {
+		opts.Host = r.Host
+	}
+	var err error
+	if opts.Concurrency, err = intParam(query.Get("concurrency"), 2, 1, 10); err != nil {
+		http.Error(w, "invalid concurrency", http.StatusBadRequest)
+		return
+	}
+	job := warmup.Start(opts, warmupRenderFunc(query.Get("force") == "true"))
+	writeJSON(w, http.StatusAccepted, job.Snapshot())
+}
+
+// lists warm-up jobs
+func handleListWarmups(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, warmup.List())
+}
+
+// returns progress of a warm-up job
+func handleGetWarmup(w http.ResponseWriter, r *http.Request) {
+	job := warmup.Get(r.PathValue("id"))
+	if job == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, job.Snapshot())
+}
+
+// request body for creating a render job
+type jobRequest struct {
+	// og:image url or path pointing at this server, e.g. /template/blog?url=...
+	ImageUrl    string `json:"image_url"`
+	CallbackUrl string `json:"callback_url"`
+	// regenerate even if the image is already cached
+	Force bool `json:"force"`
+}
+
+// queues a render job and returns 202 with the job
+func handleCreateJob(w http.ResponseWriter, r *http.Request) {
+	var body jobRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&body); err != nil {
+		http.Error(w, "invalid json body", http.StatusBadRequest)
+		return
+	}
+	imageURL, err := url.Parse(body.ImageUrl)
+	if err != nil || body.ImageUrl == "" {
+		http.Error(w, "invalid image_url", http.StatusBadRequest)
+		return
+	}
+	// validate now so bad requests fail fast instead of in the job
+	if _, err := reqDataFromImageURL(imageURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	job, err := jobs.Submit(imageURL.String(), body.CallbackUrl, body.Force)
+	if err != nil {
+		if errors.Is(err, jobs.ErrInvalidCallback) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		handleServerError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// returns the status of a render job
+func handleGetJob(w http.ResponseWriter, r *http.Request) {
+	job, err := database.GetJob(r.PathValue("id"))
+	if err != nil {
+		handleEntryError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// lists templates with their manifests. browsers get the gallery page.
+func handleListTemplates(w http.ResponseWriter, r *http.Request) {
+	if wantsHTML(r) {
+		handleTemplateGallery(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"templates": templates.ListInfo()})
+}
+
+func handleGetTemplate(w http.ResponseWriter, r *http.Request) {
+	info, err := templates.GetInfo(r.PathValue("name"))
+	if err != nil {
+		handleEntryError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// installs a template from a zip or tar archive in the request body,
+// replacing it if it exists
+func handlePutTemplate(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !templates.ValidName(name) {
+		http.Error(w, "invalid template name (letters, numbers, - and _)", http.StatusBadRequest)
+		return
+	}
+	// zip needs random access, so buffer the upload on disk
+	f, err := os.CreateTemp("", "social-image-server-template")
+	if err != nil {
+		handleServerError(w, err)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, http.MaxBytesReader(w, r.Body, templates.MaxArchiveSize))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, fmt.Sprintf("archive larger than %d bytes", templates.MaxArchiveSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "error reading body", http.StatusBadRequest)
+		return
+	}
+
+	existed := templates.IsValid(name)
+	if err := templates.Install(name, f, size); err != nil {
+		if errors.Is(err, templates.ErrInvalidArchive) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		handleServerError(w, err)
+		return
+	}
+	invalidated := invalidateTemplateCache(name)
+	slog.Info("Installed template", "template", name, "replaced", existed, "invalidated", invalidated)
+	info, err := templates.GetInfo(name)
+	if err != nil {
+		handleServerError(w, err)
+		return
+	}
+	status := http.StatusCreated
+	if existed {
+		status = http.StatusOK
+	}
+	writeJSON(w, status, map[string]any{"template": info, "invalidated": invalidated})
+}
+
+func handleDeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := templates.Remove(name); err != nil {
+		handleEntryError(w, err)
+		return
+	}
+	invalidated := invalidateTemplateCache(name)
+	slog.Info("Deleted template", "template", name, "invalidated", invalidated)
+	writeJSON(w, http.StatusOK, map[string]int{"invalidated": invalidated})
+}
+
+// deletes cached images rendered from a template. Returns the number deleted.
+func invalidateTemplateCache(name string) int {
+	// the template may already be removed from the list
+	names := append(templates.List(), name)
+	var urls []string
+	for offset := 0; ; offset += 500 {
+		images, total, err := database.ListImages(database.ImageFilter{CacheKeyPrefix: name}, 500, offset)
+		if err != nil {
+			slog.Error("Error listing template images", "template", name, "error", err)
+			return 0
+		}
+		for _, img := range images {
+			// prefix also matches templates with longer names
+			template, _ := cacheKeyTemplate(img.CacheKey, names)
+			if base, _ := templates.SplitName(template); base == name {
+				urls = append(urls, img.Url)
+			}
+		}
+		if offset+500 >= total {
+			break
+		}
+	}
+	deleted := 0
+	for len(urls) > 0 {
+		batch := urls[:min(len(urls), 500)]
+		urls = urls[len(batch):]
+		n, err := database.DeleteImages(database.ImageFilter{}, batch...)
+		if err != nil {
+			slog.Error("Error deleting template images", "template", name, "error", err)
+		}
+		deleted += n
+	}
+	return deleted
+}
+
+func handleEntryError(w http.ResponseWriter, err error) {
+	if errors.Is(err, sql.ErrNoRows) || errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	handleServerError(w, err)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Error writing json", "error", err)
+	}
+}
+
+// parses an integer param, returning def if empty. upper bound is ignored if negative.
+func intParam(value string, def, lower, upper int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < lower || (upper >= 0 && n > upper) {
+		return 0, errors.New("out of range")
+	}
+	return n, nil
+}
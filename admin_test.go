@@ -0,0 +1,295 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/henrygd/social-image-server/internal/database"
+	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/henrygd/social-image-server/internal/templates"
+	"github.com/stretchr/testify/assert"
+)
+
+const adminKey = "bernadettedevlin"
+
+// adds an image row and file to the database
+func addTestImage(t *testing.T, urlKey, cacheKey string) {
+	t.Helper()
+	f, err := os.CreateTemp(global.ImageDir, "*.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("not really a jpeg")
+	f.Close()
+	err = database.AddImage(&database.Image{
+		Url:      urlKey,
+		File:     filepath.Base(f.Name()),
+		CacheKey: cacheKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func adminRequest(router http.Handler, method, target, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAdminCache(t *testing.T) {
+	t.Setenv("ADMIN_KEY", adminKey)
+	router := setUpRouter()
+
+	addTestImage(t, "https://admin.example.com/a", "url=a")
+	addTestImage(t, "https://admin.example.com/a_b", "url=a_b")
+	addTestImage(t, "https://admin.example.com/b", "url=b")
+	addTestImage(t, "https://other.example.com/a", "url=c")
+	defer database.DeleteImages(database.ImageFilter{Prefix: "https://"})
+
+	t.Run("Requires admin key", func(t *testing.T) {
+		rr := adminRequest(router, "GET", "/admin/cache", "")
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		rr = adminRequest(router, "GET", "/admin/cache", "wrong")
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	})
+
+	t.Run("List with prefix and pagination", func(t *testing.T) {
+		rr := adminRequest(router, "GET", "/admin/cache?prefix="+url.QueryEscape("https://admin.example.com/a")+"&limit=1&offset=1", adminKey)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var body struct {
+			Total   int          `json:"total"`
+			Entries []cacheEntry `json:"entries"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		assert.Equal(t, 2, body.Total)
+		assert.Len(t, body.Entries, 1)
+		assert.Equal(t, "https://admin.example.com/a_b", body.Entries[0].Url)
+		assert.Equal(t, int64(17), body.Entries[0].Size)
+	})
+
+	t.Run("Prefix wildcards are literal", func(t *testing.T) {
+		rr := adminRequest(router, "GET", "/admin/cache?prefix="+url.QueryEscape("https://admin.example.com/a_"), adminKey)
+		assert.Contains(t, rr.Body.String(), `"total":1`)
+	})
+
+	t.Run("Invalid limit", func(t *testing.T) {
+		rr := adminRequest(router, "GET", "/admin/cache?limit=1000", adminKey)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
+	t.Run("Get entry", func(t *testing.T) {
+		rr := adminRequest(router, "GET", "/admin/cache/entry?url="+url.QueryEscape("https://admin.example.com/b"), adminKey)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var entry cacheEntry
+		json.Unmarshal(rr.Body.Bytes(), &entry)
+		assert.Equal(t, "url=b", entry.CacheKey)
+
+		rr = adminRequest(router, "GET", "/admin/cache/entry?url=missing", adminKey)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("Delete entry removes file", func(t *testing.T) {
+		img, _ := database.GetImage("https://admin.example.com/b")
+		rr := adminRequest(router, "DELETE", "/admin/cache/entry?url="+url.QueryEscape(img.Url), adminKey)
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+		assert.NoFileExists(t, filepath.Join(global.ImageDir, img.File))
+
+		rr = adminRequest(router, "DELETE", "/admin/cache/entry?url="+url.QueryEscape(img.Url), adminKey)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("Purge by domain", func(t *testing.T) {
+		rr := adminRequest(router, "DELETE", "/admin/cache", adminKey)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+		rr = adminRequest(router, "DELETE", "/admin/cache?domain=admin.example.com", adminKey)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.JSONEq(t, `{"deleted":2}`, rr.Body.String())
+
+		_, total, _ := database.ListImages(database.ImageFilter{Prefix: "https://"}, 10, 0)
+		assert.Equal(t, 1, total)
+	})
+}
+
+func TestAdminDisabledWithoutKey(t *testing.T) {
+	t.Setenv("ADMIN_KEY", "")
+	router := setUpRouter()
+	rr := adminRequest(router, "GET", "/admin/cache", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestReqDataFromCacheKey(t *testing.T) {
+	setUpRouter()
+	dir := filepath.Join(global.TemplateDir, "key-template")
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("v1"), 0644)
+	version, _ := templates.Version("key-template")
+
+	for _, path := range []string{
+		fmt.Sprintf("/capture?url=%s/about&width=1200", mockServer.URL),
+		fmt.Sprintf("/template/key-template/?url=%s&title=hello", mockServer.URL),
+		fmt.Sprintf("/template/key-template?url=%s&title=hello", mockServer.URL),
+		fmt.Sprintf("/template/key-template@%s?url=%s&title=hello", version, mockServer.URL),
+	} {
+		u, _ := url.Parse(path)
+		cacheKey := makeCacheKey(u)
+		reqData, err := reqDataFromCacheKey(cacheKey)
+		if assert.NoError(t, err, path) {
+			assert.Equal(t, cacheKey, reqData.CacheKey)
+			assert.Equal(t, u.Query(), reqData.Params)
+			if u.Path == "/capture" {
+				assert.Equal(t, "", reqData.Template)
+				assert.Equal(t, mockServer.URL+"/about", reqData.UrlKey)
+			} else {
+				assert.Equal(t, "key-template@"+version, reqData.Template)
+			}
+		}
+	}
+
+	// changing the template files changes the cache key
+	u, _ := url.Parse("/template/key-template?url=" + mockServer.URL)
+	before := makeCacheKey(u)
+	assert.Equal(t, "key-template@"+version+"url="+url.QueryEscape(mockServer.URL), before)
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("v2"), 0644)
+	templates.Refresh()
+	assert.NotEqual(t, before, makeCacheKey(u))
+
+	// keys for versions that no longer exist use the current version and its key
+	reqData, err := reqDataFromCacheKey(before)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "key-template", reqData.Template)
+		assert.Equal(t, makeCacheKey(u), reqData.CacheKey)
+	}
+	u, _ = url.Parse("/template/key-template/?url=" + mockServer.URL)
+	reqData, err = reqDataFromCacheKey("key-template@" + version + "/url=" + url.QueryEscape(mockServer.URL))
+	if assert.NoError(t, err) {
+		assert.Equal(t, makeCacheKey(u), reqData.CacheKey)
+	}
+}
+
+func TestCreateJobValidation(t *testing.T) {
+	t.Setenv("ADMIN_KEY", adminKey)
+	router := setUpRouter()
+
+	for _, tc := range []struct{ body, expected string }{
+		{`nope`, "invalid json body\n"},
+		{`{"image_url": "/nope?url=example.com"}`, "not an image url: /nope\n"},
+		{`{"image_url": "/capture?url=nytimes.com"}`, "domain nytimes.com not allowed\n"},
+		{fmt.Sprintf(`{"image_url": "/capture?url=%s", "callback_url": "nope"}`, mockServer.URL), "invalid callback_url\n"},
+	} {
+		req := httptest.NewRequest("POST", "/jobs", strings.NewReader(tc.body))
+		req.Header.Set("Authorization", "Bearer "+adminKey)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, tc.body)
+		assert.Equal(t, tc.expected, rr.Body.String())
+	}
+
+	rr := adminRequest(router, "GET", "/jobs/missing", adminKey)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestAdminTemplates(t *testing.T) {
+	t.Setenv("ADMIN_KEY", adminKey)
+	router := setUpRouter()
+	defer os.RemoveAll(filepath.Join(global.TemplateDir, "uploaded"))
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	w, _ := zw.Create("index.html")
+	w.Write([]byte("<h1>uploaded</h1>"))
+	w, _ = zw.Create("template.json")
+	w.Write([]byte(`{"params": {"title": {"max_length": 20}}}`))
+	zw.Close()
+
+	upload := func(name string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/admin/templates/"+name, bytes.NewReader(archive.Bytes()))
+		req.Header.Set("Authorization", "Bearer "+adminKey)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	rr := upload("uploaded")
+	assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), `"max_length":20`)
+	assert.Equal(t, http.StatusBadRequest, upload("bad.name").Code)
+
+	rr = adminRequest(router, "GET", "/admin/templates", adminKey)
+	assert.Contains(t, rr.Body.String(), `"name":"uploaded"`)
+	rr = adminRequest(router, "GET", "/admin/templates/uploaded", adminKey)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// replacing a template invalidates its cached images
+	addTestImage(t, "https://uploaded.example.com/a", "uploaded/url=a")
+	addTestImage(t, "https://uploaded.example.com/b", "uploaded-other/url=b")
+	defer database.DeleteImages(database.ImageFilter{Domain: "uploaded.example.com"})
+	rr = upload("uploaded")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"invalidated":1`)
+	_, total, _ := database.ListImages(database.ImageFilter{Domain: "uploaded.example.com"}, 10, 0)
+	assert.Equal(t, 1, total)
+
+	rr = adminRequest(router, "DELETE", "/admin/templates/uploaded", adminKey)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NoDirExists(t, filepath.Join(global.TemplateDir, "uploaded"))
+	rr = adminRequest(router, "DELETE", "/admin/templates/uploaded", adminKey)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestAdminTemplateGallery(t *testing.T) {
+	t.Setenv("ADMIN_KEY", adminKey)
+	router := setUpRouter()
+	dir := filepath.Join(global.TemplateDir, "gallery-template")
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+	os.WriteFile(filepath.Join(dir, "template.json"), []byte(`{"params": {"title": {"required": true, "max_length": 40}, "theme": {"enum": ["light", "dark"], "default": "dark"}}}`), 0644)
+
+	browserRequest := func(target, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Accept", "text/html,application/xhtml+xml")
+		if password != "" {
+			req.SetBasicAuth("admin", password)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// browsers are asked for the key with basic auth
+	rr := browserRequest("/admin/templates", "")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, `Basic realm="admin"`, rr.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, http.StatusUnauthorized, browserRequest("/admin/templates", "wrong").Code)
+
+	rr = browserRequest("/admin/templates", adminKey)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/html; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Contains(t, rr.Body.String(), `<form data-template="gallery-template">`)
+	assert.Contains(t, rr.Body.String(), `<input name="title" value="" maxlength="40" required />`)
+	assert.Contains(t, rr.Body.String(), `<option selected>dark</option>`)
+
+	// api clients still get json
+	rr = adminRequest(router, "GET", "/admin/templates", adminKey)
+	assert.Contains(t, rr.Body.String(), `"name":"gallery-template"`)
+
+	rr = adminRequest(router, "GET", "/admin/templates/gallery-template/preview?theme=blue", adminKey)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "title is required")
+	rr = adminRequest(router, "GET", "/admin/templates/missing/preview", adminKey)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/henrygd/social-image-server/internal/backup"
+	"github.com/henrygd/social-image-server/internal/config"
+	"github.com/henrygd/social-image-server/internal/database"
+	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/henrygd/social-image-server/internal/storage"
+	"github.com/henrygd/social-image-server/internal/warmup"
+)
+
+// runs a subcommand and exits with status 1 on failure
+func runCommand(args []string) {
+	var err error
+	switch args[0] {
+	case "config":
+		if len(args) != 2 || args[1] != "check" {
+			err = fmt.Errorf("usage: config check")
+			break
+		}
+		err = checkConfig()
+	case "export", "import":
+		if len(args) != 2 {
+			err = fmt.Errorf("usage: %s <file.tar> (use - for %s)", args[0], map[string]string{"export": "stdout", "import": "stdin"}[args[0]])
+			break
+		}
+		if args[0] == "export" {
+			err = runExport(args[1])
+		} else {
+			err = runImport(args[1])
+		}
+	case "fsck":
+		err = runFsck(args[1:])
+	case "migrate":
+		if len(args) != 2 || args[1] != "status" {
+			err = fmt.Errorf("usage: migrate status")
+			break
+		}
+		err = migrateStatus()
+	case "warmup":
+		err = runWarmup(args[1:])
+	default:
+		err = fmt.Errorf("unknown command: %s", strings.Join(args, " "))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// validates config for the config check command
+func checkConfig() error {
+	if _, err := config.Load(configFile); err != nil {
+		return err
+	}
+	fmt.Println("Configuration OK")
+	return nil
+}
+
+// writes a backup archive of the cache to a file or stdout
+func runExport(file string) error {
+	if err := openData(false); err != nil {
+		return err
+	}
+	out := os.Stdout
+	if file != "-" {
+		f, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	result, err := backup.Export(out)
+	if err != nil {
+		if file != "-" {
+			os.Remove(file)
+		}
+		return err
+	}
+	if err := out.Sync(); err != nil && file != "-" {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d images (%d rows without files dropped)\n", result.Images, result.MissingFiles)
+	return nil
+}
+
+// loads config and opens storage and the database for the backup commands.
+// Expired images aren't cleaned or evicted, since the commands can run next to
+// a live server. migrate applies pending migrations to the database that's
+// restored into.
+func openData(migrate bool) error {
+	cfg := loadConfig()
+	config.Set(cfg)
+	setLogLevel(cfg.LogLevel)
+	global.Init(cfg)
+	storage.Init(cfg)
+	if err := database.Open(); err != nil {
+		return err
+	}
+	if migrate {
+		return database.Migrate()
+	}
+	return nil
+}
+
+// restores a backup archive from a file or stdin
+func runImport(file string) error {
+	if err := openData(true); err != nil {
+		return err
+	}
+	in := os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	result, err := backup.Import(in)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d images (%d rows without files skipped, %d unused files ignored)\n", result.Images, result.MissingFiles, result.UnusedFiles)
+	return nil
+}
+
+// reconciles the images table with storage
+func runFsck(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Report problems without deleting anything")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: social-image-server fsck [options]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	initData()
+	result, err := database.Fsck(*dryRun)
+	if err != nil {
+		return err
+	}
+	action := "Removed"
+	if *dryRun {
+		action = "Found"
+	}
+	for _, file := range result.OrphanFiles {
+		fmt.Println("orphan file:", file)
+	}
+	for _, url := range result.DanglingRows {
+		fmt.Println("missing file for:", url)
+	}
+	fmt.Printf("%s %d orphan files and %d rows with missing files\n", action, len(result.OrphanFiles), len(result.DanglingRows))
+	return nil
+}
+
+// prints applied and pending database migrations without applying them
+func migrateStatus() error {
+	cfg := loadConfig()
+	global.Init(cfg)
+	if err := database.Open(); err != nil {
+		return err
+	}
+	status, err := database.Migrations()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	pending := 0
+	for _, m := range status {
+		applied := m.Applied
+		if applied == "" {
+			applied = "pending"
+			pending++
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", m.Version, m.Name, applied)
+	}
+	w.Flush()
+	fmt.Printf("%d pending migration(s). Pending migrations are applied when the server starts.\n", pending)
+	return nil
+}
+
+// renders og:images for pages in a sitemap
+func runWarmup(args []string) error {
+	flags := flag.NewFlagSet("warmup", flag.ExitOnError)
+	concurrency := flags.Int("concurrency", 2, "Number of pages processed at once")
+	force := flags.Bool("force", false, "Regenerate images that are already cached")
+	host := flags.String("host", "", "Host of og:image urls that point at this server. Defaults to PUBLIC_URL host.")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: social-image-server warmup [options] <sitemap-url>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	initServices()
+	if *host == "" {
+		*host = publicHost()
+	}
+	if *host == "" {
+		return fmt.Errorf("set PUBLIC_URL or -host so og:image urls can be matched to this server")
+	}
+
+	job := warmup.New(warmup.Options{Sitemap: flags.Arg(0), Host: *host, Concurrency: *concurrency})
+	if err := job.Run(context.Background(), warmupRenderFunc(*force)); err != nil {
+		return err
+	}
+	if snapshot := job.Snapshot(); snapshot.Failed > 0 {
+		return fmt.Errorf("%d of %d pages failed", snapshot.Failed, snapshot.Total)
+	}
+	return nil
+}
+
+// returns the render function used by warm-up jobs
+func warmupRenderFunc(force bool) warmup.RenderFunc {
+	return func(ogImageURL *url.URL) (bool, error) {
+		return renderImageURL(ogImageURL, force)
+	}
+}
+
+// returns the host of PUBLIC_URL, or empty string if not set
+func publicHost() string {
+	u, err := url.Parse(config.Get().PublicURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/config"
+	"github.com/henrygd/social-image-server/internal/database"
+	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/henrygd/social-image-server/internal/screenshot"
+	"github.com/henrygd/social-image-server/internal/storage"
+	"github.com/henrygd/social-image-server/internal/templates"
+)
+
+// template rendered when FALLBACK includes "template"
+const fallbackTemplate = "fallback"
+
+// serves a fallback image when the requested image can't be generated, trying
+// each FALLBACK source in order. Returns false without writing a response if
+// no source has an image.
+func serveFallback(w http.ResponseWriter, r *http.Request, reqData *global.ReqData, code string, status int, reason string) bool {
+	for _, source := range config.Get().Fallback {
+		var served bool
+		switch source {
+		case "last":
+			served = serveLastImage(w, r, reqData, code)
+		case "image":
+			served = serveFallbackImage(w, r, reqData, code)
+		case "template":
+			served = serveFallbackTemplate(w, r, reqData, code, status, reason)
+		}
+		if served {
+			slog.Warn("Served fallback image", "url", reqData.ValidatedURL, "source", source, "reason", reason)
+			return true
+		}
+	}
+	return false
+}
+
+// sets headers for a fallback response. fallbacks use the error cache control
+// and have no ETag, so they're replaced soon after the origin recovers instead
+// of being revalidated.
+func setFallbackHeaders(w http.ResponseWriter, source, code string) {
+	w.Header().Set("X-Og-Cache", "FALLBACK")
+	w.Header().Set("X-Og-Code", code)
+	w.Header().Set("X-Og-Fallback", source)
+	w.Header().Del("ETag")
+	w.Header().Del("Cache-Control")
+	if cacheControl := config.Get().CacheControlError; cacheControl != "" {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+}
+
+// serves the most recent image for the url, even if expired or outdated
+func serveLastImage(w http.ResponseWriter, r *http.Request, reqData *global.ReqData, code string) bool {
+	img, _ := database.GetImage(reqData.UrlKey)
+	if img.File == "" {
+		return false
+	}
+	f, _, err := storage.Open(img.File)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("Error opening last image", "file", img.File, "error", err)
+		}
+		return false
+	}
+	defer f.Close()
+	setFallbackHeaders(w, "last", code)
+	// no modification time so conditional requests always get the fallback
+	http.ServeContent(w, r, img.File, time.Time{}, f)
+	return true
+}
+
+// serves the static fallback image from the domain profile
+func serveFallbackImage(w http.ResponseWriter, r *http.Request, reqData *global.ReqData, code string) bool {
+	if reqData.Profile == nil || reqData.Profile.FallbackImage == "" {
+		return false
+	}
+	f, err := os.Open(reqData.Profile.FallbackImage)
+	if err != nil {
+		slog.Error("Error opening fallback image", "file", reqData.Profile.FallbackImage, "error", err)
+		return false
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	setFallbackHeaders(w, "image", code)
+	http.ServeContent(w, r, stat.Name(), time.Time{}, f)
+	return true
+}
+
+// renders the fallback template with the url params and the error. The image
+// isn't cached.
+func serveFallbackTemplate(w http.ResponseWriter, r *http.Request, reqData *global.ReqData, code string, status int, reason string) bool {
+	if !templates.IsValid(fallbackTemplate) || !reqData.Profile.AllowsTemplate(fallbackTemplate) {
+		return false
+	}
+	params := url.Values{}
+	for key, values := range reqData.Params {
+		if key != "_regen_" {
+			params[key] = values
+		}
+	}
+	// the fallback's own manifest decides which params it gets
+	manifest, err := templates.LoadManifest(fallbackTemplate)
+	if err != nil {
+		slog.Error("Error loading fallback template manifest", "error", err)
+		return false
+	}
+	if manifest != nil {
+		if params, err = manifest.Apply(params); err != nil {
+			slog.Warn("Params not valid for fallback template", "url", reqData.ValidatedURL, "error", err)
+			return false
+		}
+	}
+	params.Set("error", reason)
+	params.Set("status", strconv.Itoa(status))
+	buf, imageExtension, err := screenshot.Render(&global.ReqData{
+		ValidatedURL: reqData.ValidatedURL,
+		UrlKey:       reqData.UrlKey,
+		Params:       params,
+		Template:     fallbackTemplate,
+		Profile:      reqData.Profile,
+	})
+	if err != nil {
+		slog.Error("Error rendering fallback template", "error", err)
+		return false
+	}
+	setFallbackHeaders(w, "template", code)
+	http.ServeContent(w, r, fallbackTemplate+imageExtension, time.Time{}, bytes.NewReader(buf))
+	return true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/config"
+	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/henrygd/social-image-server/internal/profile"
+	"github.com/henrygd/social-image-server/internal/screenshot"
+	"github.com/henrygd/social-image-server/internal/templates"
+)
+
+//go:embed gallery.html
+var galleryHTML string
+
+var galleryPage = template.Must(template.New("gallery").Parse(galleryHTML))
+
+// template shown in the gallery, with its params in a stable order
+type galleryTemplate struct {
+	*templates.Info
+	Params []galleryParam
+}
+
+type galleryParam struct {
+	Name string
+	templates.Param
+}
+
+// checks if a request is from a browser rather than an api client
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// serves a page listing templates with a form to preview each one
+func handleTemplateGallery(w http.ResponseWriter, r *http.Request) {
+	infos := templates.ListInfo()
+	list := make([]galleryTemplate, len(infos))
+	for i, info := range infos {
+		list[i].Info = info
+		if info.Manifest == nil {
+			continue
+		}
+		for name, param := range info.Manifest.Params {
+			list[i].Params = append(list[i].Params, galleryParam{name, param})
+		}
+		sort.Slice(list[i].Params, func(a, b int) bool { return list[i].Params[a].Name < list[i].Params[b].Name })
+	}
+	var buf bytes.Buffer
+	err := galleryPage.Execute(&buf, map[string]any{
+		"Templates": list,
+		"PublicURL": strings.TrimSuffix(config.Get().PublicURL, "/"),
+	})
+	if err != nil {
+		handleServerError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buf.Bytes())
+}
+
+// renders a template with the request params. The image isn't cached and
+// the url param is optional.
+func handlePreviewTemplate(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !templates.IsValid(name) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	params := r.URL.Query()
+	params.Del("_regen_")
+	manifest, err := templates.LoadManifest(name)
+	if err != nil {
+		handleServerError(w, err)
+		return
+	}
+	if manifest != nil {
+		if params, err = manifest.Apply(params); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	reqData := &global.ReqData{Template: name, Params: params, Profile: profile.Get(profile.DefaultKey)}
+	if validatedURL, err := validateUrl(params.Get("url")); err == nil {
+		reqData.ValidatedURL = validatedURL
+		if u, err := url.Parse(validatedURL); err == nil {
+			reqData.Profile = profile.Get(u.Host)
+		}
+	}
+	start := time.Now()
+	buf, imageExtension, err := screenshot.Render(reqData)
+	if err != nil {
+		slog.Error("Error rendering preview", "template", name, "error", err)
+		http.Error(w, "Could not generate image", http.StatusInternalServerError)
+		return
+	}
+	slog.Debug("Rendered preview", "template", name, "duration", time.Since(start))
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(w, r, name+imageExtension, time.Time{}, bytes.NewReader(buf))
+}
@@ -8,7 +8,9 @@ require (
 	github.com/chromedp/chromedp v0.9.5
 	github.com/rhysd/go-github-selfupdate v1.2.3
 	github.com/stretchr/testify v1.9.0
+	golang.org/x/image v0.18.0
 	golang.org/x/net v0.25.0
+	gopkg.in/yaml.v3 v3.0.1
 	modernc.org/sqlite v1.29.8
 )
 
@@ -36,8 +38,8 @@ require (
 	golang.org/x/crypto v0.23.0 // indirect
 	golang.org/x/oauth2 v0.0.0-20181106182150-f42d05182288 // indirect
 	golang.org/x/sys v0.20.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
 	google.golang.org/appengine v1.3.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 	modernc.org/gc/v3 v3.0.0-20240107210532-573471604cb6 // indirect
 	modernc.org/libc v1.49.3 // indirect
 	modernc.org/mathutil v1.6.0 // indirect
@@ -0,0 +1,228 @@
+package backup
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/database"
+	"github.com/henrygd/social-image-server/internal/storage"
+)
+
+// name of the database snapshot in the archive. images are stored under imagesDir.
+const (
+	databaseName = "social-image-server.db"
+	imagesDir    = "images/"
+)
+
+// maximum size of a single file read from an archive
+var maxFileSize int64 = 1 << 30
+
+// Summary of an export or import
+type Result struct {
+	// images written to the archive or restored
+	Images int `json:"images"`
+	// rows dropped because their image file is missing
+	MissingFiles int `json:"missing_files"`
+	// image files in the archive not referenced by any row (import only)
+	UnusedFiles int `json:"unused_files"`
+}
+
+// Writes a tar archive containing the cached images followed by a database
+// snapshot. Rows whose image file is missing are left out of the snapshot.
+func Export(w io.Writer) (*Result, error) {
+	tmpDir, err := os.MkdirTemp("", "social-image-server-export")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	snapshotPath := filepath.Join(tmpDir, databaseName)
+	snapshot, err := database.CreateSnapshot(snapshotPath)
+	if err != nil {
+		return nil, fmt.Errorf("creating database snapshot: %w", err)
+	}
+	defer snapshot.Close()
+	images, err := snapshot.Images()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{}
+	tw := tar.NewWriter(w)
+	for _, img := range images {
+		err := writeImage(tw, img.File)
+		if errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Dropping row without image file", "url", img.Url, "file", img.File)
+			if err := snapshot.DeleteImage(img.Url); err != nil {
+				return nil, err
+			}
+			result.MissingFiles++
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", img.File, err)
+		}
+		result.Images++
+	}
+
+	// database goes last so it only contains rows with files
+	if err := snapshot.Close(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeEntry(tw, databaseName, info.Size(), info.ModTime(), f); err != nil {
+		return nil, err
+	}
+	return result, tw.Close()
+}
+
+// copies an image from storage into the archive
+func writeImage(tw *tar.Writer, file string) error {
+	f, info, err := storage.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeEntry(tw, imagesDir+path.Base(file), info.Size, info.ModTime, f)
+}
+
+func writeEntry(tw *tar.Writer, name string, size int64, modTime time.Time, r io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, r)
+	return err
+}
+
+// Restores images from an archive created by Export into storage and the
+// database. Existing images with the same url are replaced. Rows without an
+// image file in the archive are skipped.
+func Import(r io.Reader) (*Result, error) {
+	tmpDir, err := os.MkdirTemp("", "social-image-server-import")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	imageDir := filepath.Join(tmpDir, "images")
+	if err := os.Mkdir(imageDir, 0755); err != nil {
+		return nil, err
+	}
+
+	// extract everything first, since the database is at the end of the archive
+	files := map[string]bool{}
+	hasDatabase := false
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading archive: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("unexpected archive entry: %s", header.Name)
+		}
+		var dest string
+		switch {
+		case header.Name == databaseName:
+			dest = filepath.Join(tmpDir, databaseName)
+			hasDatabase = true
+		case isImageEntry(header.Name):
+			name := strings.TrimPrefix(header.Name, imagesDir)
+			dest = filepath.Join(imageDir, name)
+			files[name] = true
+		default:
+			return nil, fmt.Errorf("unexpected archive entry: %s", header.Name)
+		}
+		if err := extract(tr, header, dest); err != nil {
+			return nil, err
+		}
+	}
+	if !hasDatabase {
+		return nil, fmt.Errorf("archive does not contain %s", databaseName)
+	}
+
+	snapshot, err := database.OpenSnapshot(filepath.Join(tmpDir, databaseName))
+	if err != nil {
+		return nil, fmt.Errorf("opening database snapshot: %w", err)
+	}
+	defer snapshot.Close()
+	images, err := snapshot.Images()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{}
+	used := map[string]bool{}
+	for _, img := range images {
+		name := path.Base(img.File)
+		if !files[name] {
+			slog.Warn("Skipping row without image file", "url", img.Url, "file", img.File)
+			result.MissingFiles++
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(imageDir, name))
+		if err != nil {
+			return nil, err
+		}
+		if err := storage.Save(name, data); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		img.File = name
+		img.FileSize = int64(len(data))
+		if err := database.RestoreImage(&img); err != nil {
+			storage.Remove(name)
+			return nil, fmt.Errorf("%s: %w", img.Url, err)
+		}
+		used[name] = true
+		result.Images++
+	}
+	result.UnusedFiles = len(files) - len(used)
+	return result, nil
+}
+
+// returns true for image entries that can't escape the images directory
+func isImageEntry(name string) bool {
+	base := strings.TrimPrefix(name, imagesDir)
+	return base != name && base == path.Base(base) && base != "." && base != ".." && !strings.HasPrefix(base, ".")
+}
+
+// writes an archive entry to dest, enforcing the maximum file size
+func extract(tr *tar.Reader, header *tar.Header, dest string) error {
+	if header.Size > maxFileSize {
+		return fmt.Errorf("%s is too large", header.Name)
+	}
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("%s: %w", header.Name, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, io.LimitReader(tr, maxFileSize)); err != nil {
+		return err
+	}
+	return f.Close()
+}
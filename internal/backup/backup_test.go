@@ -0,0 +1,121 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/config"
+	"github.com/henrygd/social-image-server/internal/database"
+	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/henrygd/social-image-server/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// points the database and storage at a new empty data dir
+func useDataDir(t *testing.T) string {
+	t.Helper()
+	dataDir := t.TempDir()
+	global.DatabaseDir = dataDir
+	global.ImageDir = dataDir
+	storage.Set(storage.NewFS(dataDir))
+	database.Init(config.Default())
+	return dataDir
+}
+
+func addImage(t *testing.T, url, file, data string) {
+	t.Helper()
+	if data != "" {
+		storage.Save(file, []byte(data))
+	}
+	err := database.AddImage(&database.Image{Url: url, File: file, CacheKey: "key", FileSize: int64(len(data))})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func archiveEntries(t *testing.T, archive []byte) []string {
+	t.Helper()
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	useDataDir(t)
+	storage.Save("a.jpg", []byte("image a"))
+	database.AddImage(&database.Image{Url: "https://example.com/a", File: "a.jpg", FileSize: 7, Expires: database.ExpiresIn(time.Hour)})
+	// created before storage backends, with a leading slash
+	addImage(t, "https://example.com/b", "/b.png", "image b")
+	// file was deleted outside the server
+	addImage(t, "https://example.com/missing", "missing.jpg", "")
+
+	var archive bytes.Buffer
+	result, err := Export(&archive)
+	assert.NoError(t, err)
+	assert.Equal(t, &Result{Images: 2, MissingFiles: 1}, result)
+	assert.Equal(t, []string{"images/a.jpg", "images/b.png", "social-image-server.db"}, archiveEntries(t, archive.Bytes()))
+	// source database is untouched
+	_, total, _ := database.ListImages(database.ImageFilter{}, 10, 0)
+	assert.Equal(t, 3, total)
+	original, _ := database.GetImage("https://example.com/a")
+
+	dataDir := useDataDir(t)
+	result, err = Import(bytes.NewReader(archive.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, &Result{Images: 2}, result)
+
+	images, total, _ := database.ListImages(database.ImageFilter{}, 10, 0)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, "b.png", images[1].File)
+	data, _ := os.ReadFile(filepath.Join(dataDir, "b.png"))
+	assert.Equal(t, "image b", string(data))
+
+	// dates and expiry are kept
+	imported, _ := database.GetImage("https://example.com/a")
+	assert.Equal(t, original.Date, imported.Date)
+	assert.Equal(t, original.Expires, imported.Expires)
+	assert.Equal(t, int64(7), imported.FileSize)
+
+	// importing again replaces the same rows
+	result, err = Import(bytes.NewReader(archive.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result.Images)
+	assert.FileExists(t, filepath.Join(dataDir, "a.jpg"))
+}
+
+func TestImportRejectsBadArchives(t *testing.T) {
+	useDataDir(t)
+	for name, entries := range map[string][]string{
+		"path traversal":   {"images/../../evil.jpg"},
+		"nested directory": {"images/a/b.jpg"},
+		"unknown entry":    {"config.yaml"},
+		"missing database": {"images/a.jpg"},
+		"duplicate entry":  {"images/a.jpg", "images/a.jpg"},
+	} {
+		var archive bytes.Buffer
+		tw := tar.NewWriter(&archive)
+		for _, entry := range entries {
+			tw.WriteHeader(&tar.Header{Name: entry, Mode: 0644, Size: 4})
+			tw.Write([]byte("data"))
+		}
+		tw.Close()
+		_, err := Import(&archive)
+		assert.Error(t, err, name)
+	}
+	_, err := Import(bytes.NewReader([]byte("not a tar file")))
+	assert.Error(t, err)
+}
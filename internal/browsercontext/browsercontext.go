@@ -6,15 +6,16 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
-	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/chromedp/chromedp"
+	"github.com/henrygd/social-image-server/internal/config"
 )
 
-var remoteUrl = os.Getenv("REMOTE_URL")
+var remoteUrl string
+var fontFamily string
 var maxTabs = 5
 var openTabs chan struct{}
 var isRemoteBrowser bool
@@ -32,31 +33,17 @@ var browserContextMutex = &sync.Mutex{}
 
 var timer *time.Timer
 
-func Init() {
+func Init(cfg *config.Config) {
+	remoteUrl = cfg.RemoteURL
+	fontFamily = cfg.FontFamily
 	isRemoteBrowser = remoteUrl != ""
 	// set up max tabs
-	if tabs, ok := os.LookupEnv("MAX_TABS"); ok {
-		var err error
-		maxTabs, err = strconv.Atoi(tabs)
-		if err != nil || maxTabs < 1 {
-			slog.Error("Invalid MAX_TABS", "value", tabs, "min", 1)
-			os.Exit(1)
-		}
-	}
+	maxTabs = cfg.MaxTabs
 	slog.Debug("MAX_TABS", "value", maxTabs)
 	openTabs = make(chan struct{}, maxTabs)
 	// set up persist browser time
-	persistBrowser := os.Getenv("PERSIST_BROWSER")
-	if persistBrowser == "" {
-		persistBrowser = "5m"
-	}
-	duration, err := time.ParseDuration(persistBrowser)
-	if err != nil {
-		slog.Error(err.Error(), "PERSIST_BROWSER", persistBrowser)
-		os.Exit(1)
-	}
-	slog.Debug("PERSIST_BROWSER", "value", persistBrowser)
-	persistBrowserDuration = duration
+	slog.Debug("PERSIST_BROWSER", "value", cfg.PersistBrowser)
+	persistBrowserDuration = cfg.PersistBrowser
 
 	// set up allocator
 	cancelAllocator := setUpAllocator()
@@ -141,10 +128,9 @@ func setUpAllocator() (cancel context.CancelFunc) {
 		chromedp.Flag("audio", false),
 		// chromedp.Flag("max-gum-fps", "30"),
 	)
-	font := os.Getenv("FONT_FAMILY")
-	if font != "" {
-		slog.Debug("Using custom font", "FONT_FAMILY", font)
-		opts = append(opts, chromedp.Flag("system-font-family", font))
+	if fontFamily != "" {
+		slog.Debug("Using custom font", "FONT_FAMILY", fontFamily)
+		opts = append(opts, chromedp.Flag("system-font-family", fontFamily))
 	}
 	allocatorContext, cancel = chromedp.NewExecAllocator(context.Background(), opts...)
 
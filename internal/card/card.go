@@ -0,0 +1,192 @@
+package card
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/color"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// name of the card file in a template directory
+const File = "card.json"
+
+// Returned when a card file can't be read or is invalid
+var ErrInvalidCard = errors.New("invalid " + File)
+
+// matches {{name}} placeholders in text and image sources
+var placeholderRegex = regexp.MustCompile(`{{\s*([a-zA-Z0-9_-]+)\s*}}`)
+
+// Card template drawn without the browser. Layers are drawn in order on a
+// canvas of Width x Height css pixels (default 1200x630), which is scaled
+// to IMG_WIDTH.
+type Card struct {
+	Width  int     `json:"width"`
+	Height int     `json:"height"`
+	Layers []Layer `json:"layers"`
+}
+
+// Solid color, image or text drawn on the card. Layers without a size
+// cover the whole card.
+type Layer struct {
+	// rect, image or text
+	Type   string `json:"type"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// fill color of rects and text, like #fff or #00000080
+	Color string `json:"color"`
+	// 0 to 1. opaque if zero.
+	Opacity float64 `json:"opacity"`
+
+	// file in the template directory or an http url. Can be a placeholder.
+	Src string `json:"src"`
+	// cover (default) or contain
+	Fit string `json:"fit"`
+
+	// text with {{param}} placeholders
+	Text string `json:"text"`
+	// font file in DATA_DIR/fonts. Go Regular is used if empty.
+	Font string `json:"font"`
+	// font size in css pixels. Reduced down to MinSize until the text fits.
+	Size       float64 `json:"size"`
+	MinSize    float64 `json:"min_size"`
+	LineHeight float64 `json:"line_height"`
+	// maximum lines before the text is cut off with an ellipsis
+	MaxLines int `json:"max_lines"`
+	// left (default), center or right
+	Align string `json:"align"`
+	// top (default), middle or bottom
+	VAlign string `json:"valign"`
+}
+
+// Reads and validates a card file
+func Load(path string) (*Card, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCard, err)
+	}
+	c := &Card{Width: 1200, Height: 630}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCard, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCard, err)
+	}
+	return c, nil
+}
+
+// Checks card values and returns all errors found
+func (c *Card) Validate() error {
+	var errs []error
+	if c.Width < 200 || c.Width > 2400 || c.Height < 100 || c.Height > 2400 {
+		errs = append(errs, fmt.Errorf("invalid size %dx%d (width 200-2400, height 100-2400)", c.Width, c.Height))
+	}
+	for i, l := range c.Layers {
+		if err := l.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("layer %d: %w", i+1, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (l *Layer) validate() error {
+	var errs []error
+	switch l.Type {
+	case "rect":
+	case "image":
+		if l.Src == "" {
+			errs = append(errs, errors.New("src is required"))
+		} else if !HasPlaceholder(l.Src) && !isURL(l.Src) && !filepath.IsLocal(filepath.FromSlash(l.Src)) {
+			errs = append(errs, fmt.Errorf("invalid src %q", l.Src))
+		}
+		if l.Fit != "" && l.Fit != "cover" && l.Fit != "contain" {
+			errs = append(errs, fmt.Errorf("invalid fit %q (cover, contain)", l.Fit))
+		}
+	case "text":
+		if l.Size <= 0 || l.MinSize < 0 || l.MinSize > l.Size {
+			errs = append(errs, fmt.Errorf("invalid size %g and min_size %g", l.Size, l.MinSize))
+		}
+		if l.LineHeight < 0 || l.MaxLines < 0 {
+			errs = append(errs, errors.New("line_height and max_lines must not be negative"))
+		}
+		if l.Font != "" && (filepath.Base(l.Font) != l.Font || !filepath.IsLocal(l.Font)) {
+			errs = append(errs, fmt.Errorf("invalid font %q", l.Font))
+		}
+		switch l.Align {
+		case "", "left", "center", "right":
+		default:
+			errs = append(errs, fmt.Errorf("invalid align %q (left, center, right)", l.Align))
+		}
+		switch l.VAlign {
+		case "", "top", "middle", "bottom":
+		default:
+			errs = append(errs, fmt.Errorf("invalid valign %q (top, middle, bottom)", l.VAlign))
+		}
+	default:
+		return fmt.Errorf("invalid type %q (rect, image, text)", l.Type)
+	}
+	if l.Width < 0 || l.Height < 0 {
+		errs = append(errs, fmt.Errorf("invalid size %dx%d", l.Width, l.Height))
+	}
+	if l.Opacity < 0 || l.Opacity > 1 {
+		errs = append(errs, fmt.Errorf("invalid opacity %g (0-1)", l.Opacity))
+	}
+	if l.Color != "" {
+		if _, err := parseColor(l.Color); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Replaces {{name}} placeholders with the first value of each param, passed
+// through escape if it isn't nil. Also used by svg templates.
+func Expand(s string, params url.Values, escape func(string) string) string {
+	return placeholderRegex.ReplaceAllStringFunc(s, func(match string) string {
+		value := params.Get(placeholderRegex.FindStringSubmatch(match)[1])
+		if escape != nil {
+			value = escape(value)
+		}
+		return value
+	})
+}
+
+// Checks if a string has {{name}} placeholders
+func HasPlaceholder(s string) bool {
+	return placeholderRegex.MatchString(s)
+}
+
+func isURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// parses #rgb, #rgba, #rrggbb and #rrggbbaa colors
+func parseColor(s string) (color.NRGBA, error) {
+	hex, ok := strings.CutPrefix(s, "#")
+	if ok && (len(hex) == 3 || len(hex) == 4) {
+		var expanded strings.Builder
+		for _, r := range hex {
+			expanded.WriteString(strings.Repeat(string(r), 2))
+		}
+		hex = expanded.String()
+	}
+	if !ok || (len(hex) != 6 && len(hex) != 8) {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	n, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	return color.NRGBA{R: uint8(n >> 24), G: uint8(n >> 16), B: uint8(n >> 8), A: uint8(n)}, nil
+}
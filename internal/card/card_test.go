@@ -0,0 +1,128 @@
+package card
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/math/fixed"
+)
+
+func writeCard(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), File)
+	os.WriteFile(path, []byte(body), 0644)
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	c, err := Load(writeCard(t, `{"layers": [{"type": "text", "text": "{{title}}", "size": 64}]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1200, c.Width)
+	assert.Equal(t, 630, c.Height)
+
+	_, err = Load(writeCard(t, `{"width": 50, "layers": [
+		{"type": "circle"},
+		{"type": "image", "src": "../secret.png", "fit": "stretch"},
+		{"type": "text", "size": 20, "min_size": 30, "font": "../font.ttf", "align": "justify", "color": "red"}
+	]}`))
+	assert.ErrorIs(t, err, ErrInvalidCard)
+	for _, msg := range []string{
+		"invalid size 50x630",
+		`layer 1: invalid type "circle"`,
+		`layer 2: invalid src "../secret.png"`,
+		`invalid fit "stretch"`,
+		"layer 3: invalid size 20 and min_size 30",
+		`invalid font "../font.ttf"`,
+		`invalid align "justify"`,
+		`invalid color "red"`,
+	} {
+		assert.ErrorContains(t, err, msg)
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	for s, expected := range map[string]color.NRGBA{
+		"#fff":      {255, 255, 255, 255},
+		"#0f172a":   {15, 23, 42, 255},
+		"#00000080": {0, 0, 0, 128},
+		"#f008":     {255, 0, 0, 136},
+	} {
+		c, err := parseColor(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, expected, c, s)
+	}
+	_, err := parseColor("#ggg")
+	assert.Error(t, err)
+}
+
+func TestExpand(t *testing.T) {
+	params := url.Values{"title": {"Hello"}, "name": {"World", "ignored"}}
+	assert.Equal(t, "Hello, World! ", Expand("{{title}}, {{ name }}! {{missing}}", params, nil))
+	assert.Equal(t, "HELLO", Expand("{{title}}", params, strings.ToUpper))
+	assert.True(t, HasPlaceholder("a {{ b }}"))
+	assert.False(t, HasPlaceholder("a {{b c}}"))
+}
+
+func TestRender(t *testing.T) {
+	dir := t.TempDir()
+	background := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for i := range background.Pix {
+		background.Pix[i] = 255
+	}
+	f, _ := os.Create(filepath.Join(dir, "bg.png"))
+	png.Encode(f, background)
+	f.Close()
+
+	c := &Card{Width: 1200, Height: 630, Layers: []Layer{
+		{Type: "rect", Color: "#ff0000"},
+		{Type: "image", Src: "bg.png", X: 600, Width: 600},
+		{Type: "image", Src: "{{img}}"},
+		{Type: "text", Text: "{{title}}", X: 40, Y: 40, Width: 500, Height: 200, Size: 80, MinSize: 20, Color: "#000"},
+	}}
+	img, err := c.Render(url.Values{"title": {"A long title that needs to wrap onto more than one line"}}, Options{Dir: dir, Width: 600})
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 600, 315), img.Bounds())
+	assert.Equal(t, color.RGBA{255, 0, 0, 255}, img.At(10, 300))
+	assert.Equal(t, color.RGBA{255, 255, 255, 255}, img.At(450, 150))
+
+	// remote images need a fetch function
+	_, err = c.Render(url.Values{"img": {"https://example.com/a.png"}}, Options{Dir: dir, Width: 600})
+	assert.ErrorContains(t, err, "layer 3: remote image")
+
+	// missing fonts are an error at render time
+	global.FontDir = t.TempDir()
+	c.Layers[3].Font = "missing.ttf"
+	_, err = c.Render(url.Values{"title": {"Hi"}}, Options{Dir: dir, Width: 600})
+	assert.ErrorContains(t, err, "font missing.ttf")
+	os.WriteFile(filepath.Join(global.FontDir, "missing.ttf"), goregular.TTF, 0644)
+	_, err = c.Render(url.Values{"title": {"Hi"}}, Options{Dir: dir, Width: 600})
+	assert.NoError(t, err)
+}
+
+func TestTextLayout(t *testing.T) {
+	f, _ := loadFont("")
+	face, _ := newFace(f, 20)
+	defer face.Close()
+
+	lines := wrap(face, "one two three four five six\nseven", fixed.I(120))
+	assert.Greater(t, len(lines), 2)
+	assert.Equal(t, "seven", lines[len(lines)-1])
+
+	// lines that don't fit are cut with an ellipsis
+	l := &Layer{MaxLines: 2}
+	truncated := l.truncate(face, lines, image.Rect(0, 0, 120, 200), 24)
+	assert.Len(t, truncated, 2)
+	assert.Equal(t, lines[0], truncated[0])
+	assert.Contains(t, truncated[1], "…")
+	assert.False(t, l.fits(face, lines, image.Rect(0, 0, 120, 200), 24))
+	assert.True(t, (&Layer{}).fits(face, lines[:2], image.Rect(0, 0, 120, 48), 24))
+}
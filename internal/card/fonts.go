@@ -0,0 +1,60 @@
+package card
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/henrygd/social-image-server/internal/global"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+)
+
+// parsed fonts by file name, reloaded if the file changes
+var fonts = struct {
+	sync.Mutex
+	entries map[string]fontEntry
+}{entries: map[string]fontEntry{}}
+
+type fontEntry struct {
+	font    *opentype.Font
+	modTime int64
+}
+
+var defaultFont = sync.OnceValues(func() (*opentype.Font, error) {
+	return opentype.Parse(goregular.TTF)
+})
+
+// returns a font from DATA_DIR/fonts, or Go Regular if name is empty
+func loadFont(name string) (*opentype.Font, error) {
+	if name == "" {
+		return defaultFont()
+	}
+	path := filepath.Join(global.FontDir, name)
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("font %s: %w", name, err)
+	}
+	fonts.Lock()
+	defer fonts.Unlock()
+	if entry, ok := fonts.entries[name]; ok && entry.modTime == stat.ModTime().UnixNano() {
+		return entry.font, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("font %s: %w", name, err)
+	}
+	f, err := opentype.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("font %s: %w", name, err)
+	}
+	fonts.entries[name] = fontEntry{font: f, modTime: stat.ModTime().UnixNano()}
+	return f, nil
+}
+
+// returns a face of the font at size pixels
+func newFace(f *opentype.Font, size float64) (font.Face, error) {
+	return opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+}
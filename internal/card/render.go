@@ -0,0 +1,301 @@
+package card
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+	_ "golang.org/x/image/webp"
+)
+
+// images are decoded into memory, so their size is limited
+const maxImagePixels = 40_000_000
+
+// Settings for rendering a card
+type Options struct {
+	// template directory that image sources are relative to
+	Dir string
+	// width of the output image in pixels
+	Width int
+	// returns the path of a local copy of a remote image
+	FetchImage func(url string) (string, error)
+}
+
+// Draws the card with the params filled in
+func (c *Card) Render(params url.Values, opts Options) (image.Image, error) {
+	scale := float64(opts.Width) / float64(c.Width)
+	canvas := image.NewRGBA(image.Rect(0, 0, opts.Width, int(math.Round(float64(c.Height)*scale))))
+	// transparent areas are white in jpegs
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+	for i, l := range c.Layers {
+		bounds := l.bounds(c, scale)
+		var err error
+		switch l.Type {
+		case "rect":
+			err = l.drawRect(canvas, bounds)
+		case "image":
+			err = l.drawImage(canvas, bounds, params, opts)
+		case "text":
+			err = l.drawText(canvas, bounds, params, scale)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("layer %d: %w", i+1, err)
+		}
+	}
+	return canvas, nil
+}
+
+// returns the area of the layer in output pixels
+func (l *Layer) bounds(c *Card, scale float64) image.Rectangle {
+	width, height := l.Width, l.Height
+	if width == 0 {
+		width = c.Width - l.X
+	}
+	if height == 0 {
+		height = c.Height - l.Y
+	}
+	px := func(v int) int { return int(math.Round(float64(v) * scale)) }
+	return image.Rect(px(l.X), px(l.Y), px(l.X+width), px(l.Y+height))
+}
+
+// returns a mask for the layer opacity, or nil if it's opaque
+func (l *Layer) mask() image.Image {
+	if l.Opacity == 0 || l.Opacity == 1 {
+		return nil
+	}
+	return image.NewUniform(color.Alpha{A: uint8(math.Round(l.Opacity * 255))})
+}
+
+func (l *Layer) fill() color.Color {
+	if l.Color == "" {
+		return color.Black
+	}
+	c, _ := parseColor(l.Color)
+	return c
+}
+
+func (l *Layer) drawRect(canvas *image.RGBA, bounds image.Rectangle) error {
+	draw.DrawMask(canvas, bounds, image.NewUniform(l.fill()), image.Point{}, l.mask(), image.Point{}, draw.Over)
+	return nil
+}
+
+func (l *Layer) drawImage(canvas *image.RGBA, bounds image.Rectangle, params url.Values, opts Options) error {
+	src := Expand(l.Src, params, nil)
+	// params without a value leave the layer out
+	if src == "" {
+		return nil
+	}
+	path, err := l.imagePath(src, opts)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("image %s: %w", src, err)
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return fmt.Errorf("image %s: larger than %d pixels", src, maxImagePixels)
+	}
+	f.Seek(0, io.SeekStart)
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("image %s: %w", src, err)
+	}
+
+	// scale the image into the layer, cropped to fill it or fit inside it
+	srcBounds, dstBounds := img.Bounds(), bounds
+	srcRatio := float64(srcBounds.Dx()) / float64(srcBounds.Dy())
+	dstRatio := float64(bounds.Dx()) / float64(bounds.Dy())
+	if l.Fit == "contain" {
+		if srcRatio > dstRatio {
+			height := int(math.Round(float64(bounds.Dx()) / srcRatio))
+			dstBounds = image.Rect(0, 0, bounds.Dx(), height).Add(image.Pt(bounds.Min.X, bounds.Min.Y+(bounds.Dy()-height)/2))
+		} else {
+			width := int(math.Round(float64(bounds.Dy()) * srcRatio))
+			dstBounds = image.Rect(0, 0, width, bounds.Dy()).Add(image.Pt(bounds.Min.X+(bounds.Dx()-width)/2, bounds.Min.Y))
+		}
+	} else if srcRatio > dstRatio {
+		width := int(math.Round(float64(srcBounds.Dy()) * dstRatio))
+		srcBounds = image.Rect(0, 0, width, srcBounds.Dy()).Add(image.Pt(srcBounds.Min.X+(srcBounds.Dx()-width)/2, srcBounds.Min.Y))
+	} else {
+		height := int(math.Round(float64(srcBounds.Dx()) / dstRatio))
+		srcBounds = image.Rect(0, 0, srcBounds.Dx(), height).Add(image.Pt(srcBounds.Min.X, srcBounds.Min.Y+(srcBounds.Dy()-height)/2))
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, dstBounds.Dx(), dstBounds.Dy()))
+	xdraw.CatmullRom.Scale(scaled, scaled.Bounds(), img, srcBounds, draw.Src, nil)
+	draw.DrawMask(canvas, dstBounds, scaled, image.Point{}, l.mask(), image.Point{}, draw.Over)
+	return nil
+}
+
+// returns the path of an image in the template directory, or of a local copy
+// of a remote image
+func (l *Layer) imagePath(src string, opts Options) (string, error) {
+	if isURL(src) {
+		if opts.FetchImage == nil {
+			return "", fmt.Errorf("remote image %s not allowed", src)
+		}
+		return opts.FetchImage(src)
+	}
+	local := filepath.FromSlash(src)
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("invalid image %q", src)
+	}
+	return filepath.Join(opts.Dir, local), nil
+}
+
+func (l *Layer) drawText(canvas *image.RGBA, bounds image.Rectangle, params url.Values, scale float64) error {
+	text := strings.TrimSpace(Expand(l.Text, params, nil))
+	if text == "" {
+		return nil
+	}
+	f, err := loadFont(l.Font)
+	if err != nil {
+		return err
+	}
+	lineHeight := l.LineHeight
+	if lineHeight == 0 {
+		lineHeight = 1.2
+	}
+	minSize := l.MinSize
+	if minSize == 0 {
+		minSize = l.Size
+	}
+
+	// shrink the text until it fits the layer
+	var face font.Face
+	var lines []string
+	var linePx float64
+	for size := l.Size; ; size-- {
+		if size < minSize {
+			size = minSize
+		}
+		if face != nil {
+			face.Close()
+		}
+		if face, err = newFace(f, size*scale); err != nil {
+			return err
+		}
+		lines = wrap(face, text, fixed.I(bounds.Dx()))
+		linePx = size * scale * lineHeight
+		if size == minSize || l.fits(face, lines, bounds, linePx) {
+			break
+		}
+	}
+	defer face.Close()
+	lines = l.truncate(face, lines, bounds, linePx)
+
+	metrics := face.Metrics()
+	ascent := float64(metrics.Ascent) / 64
+	// half the space between lines goes above the text, as in css
+	halfLeading := (linePx - float64(metrics.Ascent+metrics.Descent)/64) / 2
+	top := float64(bounds.Min.Y)
+	switch l.VAlign {
+	case "middle":
+		top += (float64(bounds.Dy()) - linePx*float64(len(lines))) / 2
+	case "bottom":
+		top += float64(bounds.Dy()) - linePx*float64(len(lines))
+	}
+	src := image.Image(image.NewUniform(l.fill()))
+	dst := draw.Image(canvas)
+	if mask := l.mask(); mask != nil {
+		// text is drawn on a transparent layer and blended in
+		layer := image.NewRGBA(canvas.Bounds())
+		defer draw.DrawMask(canvas, canvas.Bounds(), layer, image.Point{}, mask, image.Point{}, draw.Over)
+		dst = layer
+	}
+	d := &font.Drawer{Dst: dst, Src: src, Face: face}
+	for i, line := range lines {
+		width := d.MeasureString(line)
+		x := fixed.I(bounds.Min.X)
+		switch l.Align {
+		case "center":
+			x += (fixed.I(bounds.Dx()) - width) / 2
+		case "right":
+			x += fixed.I(bounds.Dx()) - width
+		}
+		y := top + float64(i)*linePx + halfLeading + ascent
+		d.Dot = fixed.Point26_6{X: x, Y: fixed.Int26_6(math.Round(y * 64))}
+		d.DrawString(line)
+	}
+	return nil
+}
+
+// checks if lines fit the layer at the current size
+func (l *Layer) fits(face font.Face, lines []string, bounds image.Rectangle, linePx float64) bool {
+	if l.MaxLines > 0 && len(lines) > l.MaxLines {
+		return false
+	}
+	if float64(len(lines))*linePx > float64(bounds.Dy())+0.5 {
+		return false
+	}
+	for _, line := range lines {
+		if font.MeasureString(face, line) > fixed.I(bounds.Dx()) {
+			return false
+		}
+	}
+	return true
+}
+
+// cuts lines that don't fit the layer, ending the last line with an ellipsis
+func (l *Layer) truncate(face font.Face, lines []string, bounds image.Rectangle, linePx float64) []string {
+	maxLines := max(1, int((float64(bounds.Dy())+0.5)/linePx))
+	if l.MaxLines > 0 {
+		maxLines = min(maxLines, l.MaxLines)
+	}
+	if len(lines) <= maxLines {
+		return lines
+	}
+	lines = lines[:maxLines]
+	last := lines[maxLines-1]
+	for {
+		if font.MeasureString(face, last+"…") <= fixed.I(bounds.Dx()) {
+			break
+		}
+		i := strings.LastIndex(last, " ")
+		if i <= 0 {
+			break
+		}
+		last = last[:i]
+	}
+	lines[maxLines-1] = strings.TrimRight(last, " ,.;:") + "…"
+	return lines
+}
+
+// splits text into lines no wider than width. Words wider than the line are
+// left on their own line.
+func wrap(face font.Face, text string, width fixed.Int26_6) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			if line == "" {
+				line = word
+			} else if font.MeasureString(face, line+" "+word) <= width {
+				line += " " + word
+			} else {
+				lines = append(lines, line)
+				line = word
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
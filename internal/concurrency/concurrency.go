@@ -49,3 +49,18 @@ func CleanUrlMutexes(now time.Time) {
 	}
 	slog.Debug("Cleaned UrlMutexes", "count", len(UrlMutexes))
 }
+
+// urls being regenerated in the background
+var revalidating sync.Map
+
+// Marks the url as being regenerated in the background.
+// Returns false if it already is.
+func StartRevalidation(url string) bool {
+	_, loaded := revalidating.LoadOrStore(url, struct{}{})
+	return !loaded
+}
+
+// Marks background regeneration of the url as finished
+func FinishRevalidation(url string) {
+	revalidating.Delete(url)
+}
@@ -53,6 +53,21 @@ func TestCleanUrlMutexes(t *testing.T) {
 	}
 }
 
+func TestRevalidation(t *testing.T) {
+	url := "https://example.com/stale"
+	if !StartRevalidation(url) {
+		t.Errorf("Expected first revalidation to start")
+	}
+	if StartRevalidation(url) {
+		t.Errorf("Expected second revalidation not to start while the first is running")
+	}
+	FinishRevalidation(url)
+	if !StartRevalidation(url) {
+		t.Errorf("Expected revalidation to start after the previous one finished")
+	}
+	FinishRevalidation(url)
+}
+
 func BenchmarkGetOrCreateUrlMutex(b *testing.B) {
 	url := "https://example.com"
 	for i := 0; i < b.N; i++ {
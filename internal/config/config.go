@@ -0,0 +1,349 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/profile"
+	"gopkg.in/yaml.v3"
+)
+
+// Server configuration. Loaded from an optional yaml file, then
+// overridden by environment variables of the same name in uppercase.
+type Config struct {
+	AdminKey          string                      `yaml:"admin_key" env:"ADMIN_KEY"`
+	AllowedDomains    []string                    `yaml:"allowed_domains" env:"ALLOWED_DOMAINS" reload:"true"`
+	CacheControlError string                      `yaml:"cache_control_error" env:"CACHE_CONTROL_ERROR" reload:"true"`
+	CacheControlHit   string                      `yaml:"cache_control_hit" env:"CACHE_CONTROL_HIT" reload:"true"`
+	CacheControlMiss  string                      `yaml:"cache_control_miss" env:"CACHE_CONTROL_MISS" reload:"true"`
+	CacheMaxEntries   int                         `yaml:"cache_max_entries" env:"CACHE_MAX_ENTRIES" reload:"true"`
+	CacheMaxSize      string                      `yaml:"cache_max_size" env:"CACHE_MAX_SIZE" reload:"true"`
+	CacheTime         string                      `yaml:"cache_time" env:"CACHE_TIME" reload:"true"`
+	DataDir           string                      `yaml:"data_dir" env:"DATA_DIR"`
+	Fallback          []string                    `yaml:"fallback" env:"FALLBACK" reload:"true"`
+	FontFamily        string                      `yaml:"font_family" env:"FONT_FAMILY"`
+	ImageProxy        bool                        `yaml:"image_proxy" env:"IMAGE_PROXY" reload:"true"`
+	ImageProxyDomains []string                    `yaml:"image_proxy_domains" env:"IMAGE_PROXY_DOMAINS" reload:"true"`
+	ImageProxyMaxSize string                      `yaml:"image_proxy_max_size" env:"IMAGE_PROXY_MAX_SIZE" reload:"true"`
+	ImgFormat         string                      `yaml:"img_format" env:"IMG_FORMAT"`
+	ImgQuality        int64                       `yaml:"img_quality" env:"IMG_QUALITY"`
+	ImgWidth          float64                     `yaml:"img_width" env:"IMG_WIDTH"`
+	JobWorkers        int                         `yaml:"job_workers" env:"JOB_WORKERS"`
+	LogLevel          string                      `yaml:"log_level" env:"LOG_LEVEL" reload:"true"`
+	MaxTabs           int                         `yaml:"max_tabs" env:"MAX_TABS"`
+	PersistBrowser    time.Duration               `yaml:"persist_browser" env:"PERSIST_BROWSER"`
+	Port              string                      `yaml:"port" env:"PORT"`
+	ProfilesFile      string                      `yaml:"profiles_file" env:"PROFILES_FILE" reload:"true"`
+	Profiles          map[string]*profile.Profile `yaml:"profiles" reload:"true"`
+	PublicURL         string                      `yaml:"public_url" env:"PUBLIC_URL"`
+	RegenKey          string                      `yaml:"regen_key" env:"REGEN_KEY"`
+	RemoteURL         string                      `yaml:"remote_url" env:"REMOTE_URL"`
+	S3AccessKey       string                      `yaml:"s3_access_key" env:"S3_ACCESS_KEY"`
+	S3Bucket          string                      `yaml:"s3_bucket" env:"S3_BUCKET"`
+	S3Endpoint        string                      `yaml:"s3_endpoint" env:"S3_ENDPOINT"`
+	S3PathStyle       bool                        `yaml:"s3_path_style" env:"S3_PATH_STYLE"`
+	S3Prefix          string                      `yaml:"s3_prefix" env:"S3_PREFIX"`
+	S3Redirect        bool                        `yaml:"s3_redirect" env:"S3_REDIRECT"`
+	S3Region          string                      `yaml:"s3_region" env:"S3_REGION"`
+	S3SecretKey       string                      `yaml:"s3_secret_key" env:"S3_SECRET_KEY"`
+	S3URLExpiry       time.Duration               `yaml:"s3_url_expiry" env:"S3_URL_EXPIRY"`
+	ServeStale        bool                        `yaml:"serve_stale" env:"SERVE_STALE" reload:"true"`
+	Storage           string                      `yaml:"storage" env:"STORAGE"`
+	WebhookSecret     string                      `yaml:"webhook_secret" env:"WEBHOOK_SECRET"`
+}
+
+// bounds for CACHE_TIME
+const (
+	MinCacheTime = profile.MinCacheTime
+	MaxCacheTime = profile.MaxCacheTime
+)
+
+// matches sizes like "500MB" or "2 GB"
+var sizeRegex = regexp.MustCompile(`^(\d+(?:\.\d+)?) ?([KMGT]?B)?$`)
+
+var sizeUnits = map[string]float64{"": 1, "B": 1, "KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30, "TB": 1 << 40}
+
+var current *Config
+var currentLock sync.RWMutex
+
+// Returns a config with default values
+func Default() *Config {
+	return &Config{
+		CacheControlError: "public, max-age=60",
+		CacheControlHit:   "public, max-age=86400, stale-while-revalidate=604800",
+		CacheControlMiss:  "public, max-age=86400, stale-while-revalidate=604800",
+		CacheTime:         "30 days",
+		DataDir:           "./data",
+		ImageProxyMaxSize: "10MB",
+		ImgFormat:         "jpeg",
+		ImgQuality:        92,
+		ImgWidth:          2000,
+		JobWorkers:        2,
+		LogLevel:          "info",
+		MaxTabs:           5,
+		PersistBrowser:    5 * time.Minute,
+		Port:              "8080",
+		S3Region:          "us-east-1",
+		S3URLExpiry:       time.Hour,
+		Storage:           "fs",
+	}
+}
+
+// Loads config from defaults, the file at path (if not empty), and environment
+// variables, then validates it. All problems found are returned together.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	var errs []error
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	// profiles file is validated on load
+	if err := cfg.loadProfilesFile(); err != nil {
+		errs = append(errs, err)
+	}
+	return cfg, errors.Join(errs...)
+}
+
+// overrides config fields with environment variables from the env struct tag
+func (c *Config) loadEnv() error {
+	var errs []error
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("env")
+		value, ok := os.LookupEnv(name)
+		if name == "" || !ok {
+			continue
+		}
+		field := v.Field(i)
+		switch field.Interface().(type) {
+		case string:
+			field.SetString(value)
+		case []string:
+			var list []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+		case bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q: not a boolean", name, value))
+				continue
+			}
+			field.SetBool(b)
+		case time.Duration:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q: %w", name, value, err))
+				continue
+			}
+			field.SetInt(int64(d))
+		case int, int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q: not an integer", name, value))
+				continue
+			}
+			field.SetInt(n)
+		case float64:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q: not a number", name, value))
+				continue
+			}
+			field.SetFloat(f)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// loads profiles from ProfilesFile or DATA_DIR/profiles.yaml if it exists.
+// profiles in the file take precedence over profiles in the config file.
+func (c *Config) loadProfilesFile() error {
+	path := c.ProfilesFile
+	if path == "" {
+		path = filepath.Join(c.DataDir, "profiles.yaml")
+		if _, err := os.Stat(path); err != nil {
+			return nil
+		}
+	}
+	loaded, err := profile.Load(path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if c.Profiles == nil {
+		c.Profiles = make(map[string]*profile.Profile, len(loaded))
+	}
+	for domain, p := range loaded {
+		c.Profiles[domain] = p
+	}
+	return nil
+}
+
+// Parses a cache time in Go duration syntax ("720h") or as a count
+// of units ("30 days"). Months are 30 days and years are 365 days.
+func ParseCacheTime(value string) (time.Duration, error) {
+	return profile.ParseCacheTime(value)
+}
+
+// Parses a size like "500MB" or "2 GB" into bytes. Units are powers of 1024.
+// An empty string returns zero.
+func ParseSize(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	match := sizeRegex.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(value)))
+	if match == nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	n, _ := strconv.ParseFloat(match[1], 64)
+	return int64(n * sizeUnits[match[2]]), nil
+}
+
+// Checks config values and returns all errors found
+func (c *Config) Validate() error {
+	var errs []error
+	if d, err := ParseCacheTime(c.CacheTime); err != nil {
+		errs = append(errs, fmt.Errorf("invalid CACHE_TIME %q (examples: \"30 days\", \"720h\")", c.CacheTime))
+	} else if d < MinCacheTime || d > MaxCacheTime {
+		errs = append(errs, fmt.Errorf("invalid CACHE_TIME %q (min 1 hour, max 10 years)", c.CacheTime))
+	}
+	if _, err := ParseSize(c.CacheMaxSize); err != nil {
+		errs = append(errs, fmt.Errorf("invalid CACHE_MAX_SIZE %q (example: \"5GB\")", c.CacheMaxSize))
+	}
+	if c.CacheMaxEntries < 0 {
+		errs = append(errs, fmt.Errorf("invalid CACHE_MAX_ENTRIES %d (min 0)", c.CacheMaxEntries))
+	}
+	if c.DataDir == "" {
+		errs = append(errs, errors.New("DATA_DIR must not be empty"))
+	}
+	for _, source := range c.Fallback {
+		switch source {
+		case "last", "image", "template":
+		default:
+			errs = append(errs, fmt.Errorf("invalid FALLBACK %q (last, image, template)", source))
+		}
+	}
+	if size, err := ParseSize(c.ImageProxyMaxSize); err != nil || size < 1 {
+		errs = append(errs, fmt.Errorf("invalid IMAGE_PROXY_MAX_SIZE %q (example: \"10MB\")", c.ImageProxyMaxSize))
+	}
+	if c.ImgFormat != "jpeg" && c.ImgFormat != "png" {
+		errs = append(errs, fmt.Errorf("invalid IMG_FORMAT %q (jpeg, png)", c.ImgFormat))
+	}
+	if c.ImgQuality < 1 || c.ImgQuality > 100 {
+		errs = append(errs, fmt.Errorf("invalid IMG_QUALITY %d (min 1, max 100)", c.ImgQuality))
+	}
+	if c.ImgWidth < 1000 || c.ImgWidth > 2500 {
+		errs = append(errs, fmt.Errorf("invalid IMG_WIDTH %g (min 1000, max 2500)", c.ImgWidth))
+	}
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("invalid LOG_LEVEL %q (debug, info, warn, error)", c.LogLevel))
+	}
+	if c.JobWorkers < 1 {
+		errs = append(errs, fmt.Errorf("invalid JOB_WORKERS %d (min 1)", c.JobWorkers))
+	}
+	if c.MaxTabs < 1 {
+		errs = append(errs, fmt.Errorf("invalid MAX_TABS %d (min 1)", c.MaxTabs))
+	}
+	if c.PersistBrowser <= 0 {
+		errs = append(errs, fmt.Errorf("invalid PERSIST_BROWSER %s (must be positive)", c.PersistBrowser))
+	}
+	if c.PublicURL != "" {
+		if u, err := url.Parse(c.PublicURL); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("invalid PUBLIC_URL %q (example: \"https://og.example.com\")", c.PublicURL))
+		}
+	}
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("invalid PORT %q", c.Port))
+	}
+	switch c.Storage {
+	case "fs":
+	case "s3":
+		if u, err := url.Parse(c.S3Endpoint); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("invalid S3_ENDPOINT %q (example: \"https://s3.us-east-1.amazonaws.com\")", c.S3Endpoint))
+		}
+		if c.S3Bucket == "" {
+			errs = append(errs, errors.New("S3_BUCKET is required for s3 storage"))
+		}
+		if c.S3AccessKey == "" || c.S3SecretKey == "" {
+			errs = append(errs, errors.New("S3_ACCESS_KEY and S3_SECRET_KEY are required for s3 storage"))
+		}
+		if c.S3URLExpiry < time.Second || c.S3URLExpiry > 7*24*time.Hour {
+			errs = append(errs, fmt.Errorf("invalid S3_URL_EXPIRY %s (min 1s, max 168h)", c.S3URLExpiry))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid STORAGE %q (fs, s3)", c.Storage))
+	}
+	for domain, p := range c.Profiles {
+		if p == nil {
+			c.Profiles[domain] = &profile.Profile{}
+			continue
+		}
+		if err := p.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("profile %s: %w", domain, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Returns a copy of c with the reloadable settings of next applied,
+// along with the names of changed settings that require a restart.
+func (c *Config) Reload(next *Config) (reloaded *Config, restartRequired []string) {
+	copied := *c
+	v := reflect.ValueOf(&copied).Elem()
+	nextV := reflect.ValueOf(next).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get("reload") == "true" {
+			v.Field(i).Set(nextV.Field(i))
+			continue
+		}
+		if !reflect.DeepEqual(v.Field(i).Interface(), nextV.Field(i).Interface()) {
+			restartRequired = append(restartRequired, strings.Split(field.Tag.Get("yaml"), ",")[0])
+		}
+	}
+	return &copied, restartRequired
+}
+
+// Sets the active config
+func Set(c *Config) {
+	currentLock.Lock()
+	defer currentLock.Unlock()
+	current = c
+}
+
+// Returns the active config
+func Get() *Config {
+	currentLock.RLock()
+	defer currentLock.RUnlock()
+	return current
+}
@@ -0,0 +1,167 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDefaults(t *testing.T) {
+	cfg, err := config.Load("")
+	assert.NoError(t, err)
+	assert.Equal(t, config.Default(), cfg)
+}
+
+func TestLoadFileAndEnv(t *testing.T) {
+	path := writeConfig(t, `
+port: 3000
+allowed_domains: [example.com, example.org]
+img_format: png
+img_quality: 80
+persist_browser: 10m
+profiles:
+  example.com:
+    width: 1200
+`)
+	t.Setenv("IMG_QUALITY", "70")
+	t.Setenv("ALLOWED_DOMAINS", "example.net, example.io")
+
+	cfg, err := config.Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "3000", cfg.Port)
+	assert.Equal(t, "png", cfg.ImgFormat)
+	assert.Equal(t, 10*time.Minute, cfg.PersistBrowser)
+	assert.Equal(t, int64(1200), cfg.Profiles["example.com"].Width)
+	// env overrides file
+	assert.Equal(t, int64(70), cfg.ImgQuality)
+	assert.Equal(t, []string{"example.net", "example.io"}, cfg.AllowedDomains)
+}
+
+func TestLoadReportsAllErrors(t *testing.T) {
+	path := writeConfig(t, `
+img_format: webp
+log_level: verbose
+profiles:
+  example.com:
+    format: gif
+`)
+	t.Setenv("MAX_TABS", "zero")
+	t.Setenv("IMG_WIDTH", "200")
+	t.Setenv("FALLBACK", "last,blank")
+	t.Setenv("IMAGE_PROXY_MAX_SIZE", "lots")
+
+	_, err := config.Load(path)
+	assert.ErrorContains(t, err, `invalid MAX_TABS "zero"`)
+	assert.ErrorContains(t, err, "invalid IMG_WIDTH 200")
+	assert.ErrorContains(t, err, `invalid IMG_FORMAT "webp"`)
+	assert.ErrorContains(t, err, `invalid LOG_LEVEL "verbose"`)
+	assert.ErrorContains(t, err, `invalid FALLBACK "blank"`)
+	assert.ErrorContains(t, err, `invalid IMAGE_PROXY_MAX_SIZE "lots"`)
+	assert.ErrorContains(t, err, `profile example.com: invalid format "gif"`)
+}
+
+func TestS3StorageRequiresSettings(t *testing.T) {
+	t.Setenv("STORAGE", "s3")
+	t.Setenv("S3_PATH_STYLE", "yes please")
+	_, err := config.Load("")
+	assert.ErrorContains(t, err, `invalid S3_PATH_STYLE "yes please"`)
+	assert.ErrorContains(t, err, `invalid S3_ENDPOINT ""`)
+	assert.ErrorContains(t, err, "S3_BUCKET is required")
+
+	t.Setenv("S3_PATH_STYLE", "true")
+	t.Setenv("S3_ENDPOINT", "http://localhost:9000")
+	t.Setenv("S3_BUCKET", "images")
+	t.Setenv("S3_ACCESS_KEY", "access")
+	t.Setenv("S3_SECRET_KEY", "secret")
+	cfg, err := config.Load("")
+	assert.NoError(t, err)
+	assert.True(t, cfg.S3PathStyle)
+}
+
+func TestParseCacheTime(t *testing.T) {
+	day := 24 * time.Hour
+	for value, expected := range map[string]time.Duration{
+		"30 days": 30 * day,
+		"1 Hour":  time.Hour,
+		"2weeks":  14 * day,
+		"1 year":  365 * day,
+		"36h30m":  36*time.Hour + 30*time.Minute,
+	} {
+		d, err := config.ParseCacheTime(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, expected, d, value)
+	}
+	for _, value := range []string{"", "soon", "30 days'); DROP TABLE images; --", "99999999999999999999 years"} {
+		_, err := config.ParseCacheTime(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestCacheTimeBounds(t *testing.T) {
+	for value, valid := range map[string]bool{"30 minutes": false, "1 hour": true, "10 years": true, "11 years": false} {
+		t.Setenv("CACHE_TIME", value)
+		_, err := config.Load("")
+		if valid {
+			assert.NoError(t, err, value)
+		} else {
+			assert.ErrorContains(t, err, "min 1 hour, max 10 years", value)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for value, expected := range map[string]int64{"": 0, "512": 512, "1KB": 1024, "1.5 MB": 1572864, "2gb": 2 << 30} {
+		size, err := config.ParseSize(value)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, size, value)
+	}
+	_, err := config.ParseSize("lots")
+	assert.Error(t, err)
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	_, err := config.Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestProfilesFile(t *testing.T) {
+	dataDir := t.TempDir()
+	os.WriteFile(filepath.Join(dataDir, "profiles.yaml"), []byte("example.com:\n  width: 900\n"), 0644)
+	t.Setenv("DATA_DIR", dataDir)
+
+	cfg, err := config.Load("")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(900), cfg.Profiles["example.com"].Width)
+}
+
+func TestReload(t *testing.T) {
+	cfg := config.Default()
+	next := config.Default()
+	next.LogLevel = "debug"
+	next.CacheTime = "2 days"
+	next.AllowedDomains = []string{"example.com"}
+	next.Port = "9000"
+
+	reloaded, restartRequired := cfg.Reload(next)
+	assert.Equal(t, "debug", reloaded.LogLevel)
+	assert.Equal(t, "2 days", reloaded.CacheTime)
+	assert.Equal(t, []string{"example.com"}, reloaded.AllowedDomains)
+	// port can't change without restart
+	assert.Equal(t, "8080", reloaded.Port)
+	assert.Equal(t, []string{"port"}, restartRequired)
+	// original is not modified
+	assert.Equal(t, "info", cfg.LogLevel)
+}
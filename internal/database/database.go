@@ -2,99 +2,233 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"log/slog"
-	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/henrygd/social-image-server/internal/config"
 	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/henrygd/social-image-server/internal/storage"
 	_ "modernc.org/sqlite"
 )
 
 var db *sql.DB
 
+var cacheTime = 30 * 24 * time.Hour
+var cacheTimeLock sync.RWMutex
+
+// limits enforced by evicting least recently served images. zero is unlimited.
+var cacheMaxSize int64
+var cacheMaxEntries int
+var cacheLimitsLock sync.RWMutex
+
 type Image struct {
 	Url      string
 	File     string
 	Date     string
 	CacheKey string
+	// size of the file in bytes
+	FileSize int64
+	// time the image was last served
+	LastAccess string
+	// time the image expires in UTC. Empty to use CACHE_TIME.
+	Expires string
+	// hex sha256 of the file contents
+	Hash string
+}
+
+// columns selected for Image, in scan order
+const imageColumns = `url, file, date, cache_key, size, COALESCE(last_access, date), COALESCE(expires, ''), hash`
+
+func (img *Image) scanFrom(row interface{ Scan(...any) error }) error {
+	return row.Scan(&img.Url, &img.File, &img.Date, &img.CacheKey, &img.FileSize, &img.LastAccess, &img.Expires, &img.Hash)
+}
+
+// parses a DATETIME value. Returns zero time if it can't be parsed.
+func parseTime(value string) time.Time {
+	// driver returns DATETIME as RFC3339, but fall back to sqlite's format just in case
+	for _, layout := range []string{time.RFC3339Nano, time.DateTime} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Returns the time the image was created. Returns zero time if date can't be parsed.
+func (img *Image) CreatedAt() time.Time {
+	return parseTime(img.Date)
+}
+
+// Returns true if the image has its own expiry time and it has passed.
+// Images without one are removed by Clean after CACHE_TIME.
+func (img *Image) Expired() bool {
+	expires := parseTime(img.Expires)
+	return !expires.IsZero() && time.Now().After(expires)
+}
+
+// Returns an expiry time for an image cached for d, formatted for Image.Expires
+func ExpiresIn(d time.Duration) string {
+	return time.Now().UTC().Add(d).Format(time.DateTime)
+}
+
+// Sets how long images without their own expiry time are cached
+func SetCacheTime(d time.Duration) {
+	cacheTimeLock.Lock()
+	defer cacheTimeLock.Unlock()
+	cacheTime = d
+}
+
+func getCacheTime() time.Duration {
+	cacheTimeLock.RLock()
+	defer cacheTimeLock.RUnlock()
+	return cacheTime
+}
+
+// Sets the maximum total size in bytes and number of cached images. Zero disables a limit.
+func SetCacheLimits(maxSize int64, maxEntries int) {
+	cacheLimitsLock.Lock()
+	defer cacheLimitsLock.Unlock()
+	cacheMaxSize, cacheMaxEntries = maxSize, maxEntries
+}
+
+func getCacheLimits() (int64, int) {
+	cacheLimitsLock.RLock()
+	defer cacheLimitsLock.RUnlock()
+	return cacheMaxSize, cacheMaxEntries
 }
 
-func getCleanInterval() string {
-	if cleanInterval, ok := os.LookupEnv("CACHE_TIME"); ok {
-		return cleanInterval
+func Init(cfg *config.Config) {
+	// config is validated before init
+	cacheTime, _ := config.ParseCacheTime(cfg.CacheTime)
+	SetCacheTime(cacheTime)
+	maxSize, _ := config.ParseSize(cfg.CacheMaxSize)
+	SetCacheLimits(maxSize, cfg.CacheMaxEntries)
+	slog.Debug("Initializing database", "CACHE_TIME", cacheTime, "CACHE_MAX_SIZE", maxSize, "CACHE_MAX_ENTRIES", cfg.CacheMaxEntries)
+	if err := Open(); err != nil {
+		log.Fatal(err)
 	}
-	return "30 days"
+	if err := Migrate(); err != nil {
+		log.Fatal("Error migrating database: ", err)
+	}
+	Clean()
 }
 
-func Init() {
-	slog.Debug("Initializing database", "CACHE_TIME", getCleanInterval())
+// Opens the database without applying migrations
+func Open() error {
 	var err error
 	db, err = sql.Open("sqlite", filepath.Join(global.DatabaseDir, "social-image-server.db"))
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	// limit open connections to avoid SQLITE_BUSY
 	db.SetMaxOpenConns(1)
-	// create table
-	if _, err = db.Exec(
-		`CREATE TABLE IF NOT EXISTS images (
-			url TEXT NOT NULL PRIMARY KEY,
-			file TEXT NOT NULL,
-			date DATETIME DEFAULT CURRENT_TIMESTAMP
-		)`,
-	); err != nil {
-		log.Fatal("Error creating table:", err)
-	}
-	// add index to url column
-	if _, err = db.Exec(`CREATE INDEX IF NOT EXISTS url_index ON images (url);`); err != nil {
-		log.Fatal("Error creating index:", err)
-	}
-	runDatabaseUpdates()
-	Clean()
+	return nil
 }
 
 func AddImage(img *Image) error {
 	slog.Debug("Adding image to database", "url", img.Url)
-	// check if row with the same URL exists
+	// the old file is read and the row replaced in one transaction so
+	// concurrent renders of the same url can't both remove the same file
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 	var file string
-	row := db.QueryRow(
-		`SELECT file FROM images WHERE url=?;`, img.Url,
-	)
-	err := row.Scan(&file)
+	err = tx.QueryRow(`SELECT file FROM images WHERE url=?;`, img.Url).Scan(&file)
 	if err != nil && err != sql.ErrNoRows {
 		return err
 	}
-
-	// If old row exists, update row and delete old file
-	if file != "" {
-		_, err = db.Exec("UPDATE images SET file = ?, cache_key = ? WHERE url = ?", img.File, img.CacheKey, img.Url)
-		if err != nil {
-			return err
-		}
-		if err = os.Remove(global.ImageDir + file); err != nil {
-			return err
-		}
-		slog.Debug("Updated existing row", "url", img.Url)
-		return nil
-	}
-
-	_, err = db.Exec("INSERT INTO images (url, file, cache_key) VALUES (?, ?, ?)", img.Url, img.File, img.CacheKey)
+	_, err = tx.Exec(
+		`INSERT INTO images (url, file, cache_key, size, expires, hash, last_access)
+			VALUES (?, ?, ?, ?, NULLIF(?, ''), ?, CURRENT_TIMESTAMP)
+			ON CONFLICT (url) DO UPDATE SET file = excluded.file, cache_key = excluded.cache_key,
+				size = excluded.size, expires = excluded.expires, hash = excluded.hash,
+				date = CURRENT_TIMESTAMP, last_access = CURRENT_TIMESTAMP`,
+		img.Url, img.File, img.CacheKey, img.FileSize, img.Expires, img.Hash,
+	)
 	if err != nil {
 		return err
 	}
-	slog.Debug("New row inserted", "url", img.Url)
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	// the old file is only removed once the row points at the new one
+	if file != "" && file != img.File {
+		removeFiles([]string{file})
+	}
+	slog.Debug("Saved image row", "url", img.Url, "replaced", file != "")
+	// make room for the new image
+	if _, err := evict(img.Url); err != nil {
+		slog.Error("Error evicting images", "error", err)
+	}
 	return nil
 }
 
+// Updates the last access time of an image so it isn't evicted
+func TouchImage(url string) error {
+	_, err := db.Exec("UPDATE images SET last_access = CURRENT_TIMESTAMP WHERE url = ?", url)
+	return err
+}
+
+// Deletes the least recently served images until the cache is within
+// CACHE_MAX_SIZE and CACHE_MAX_ENTRIES. The image at keep is never evicted.
+// Returns the number of deleted images.
+func evict(keep string) (int, error) {
+	maxSize, maxEntries := getCacheLimits()
+	if maxSize <= 0 && maxEntries <= 0 {
+		return 0, nil
+	}
+	// running count and size of images from most to least recently served
+	rows, err := db.Query(
+		`DELETE FROM images WHERE url IN (
+			SELECT url FROM (
+				SELECT url,
+					ROW_NUMBER() OVER recent AS n,
+					SUM(size) OVER recent AS total
+				FROM images
+				WINDOW recent AS (ORDER BY url = ? DESC, COALESCE(last_access, date) DESC, rowid DESC)
+			)
+			WHERE url != ? AND ((? > 0 AND n > ?) OR (? > 0 AND total > ?))
+		) RETURNING file`,
+		keep, keep, maxEntries, maxEntries, maxSize, maxSize,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var files []string
+	for rows.Next() {
+		var file string
+		if err := rows.Scan(&file); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		files = append(files, file)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	removeFiles(files)
+	if len(files) > 0 {
+		slog.Debug("Evicted images", "count", len(files))
+	}
+	return len(files), nil
+}
+
 func GetImage(url string) (*Image, error) {
 	var image Image
 
-	row := db.QueryRow(`SELECT * FROM images WHERE url=?`, url)
+	row := db.QueryRow(`SELECT `+imageColumns+` FROM images WHERE url=?`, url)
 
-	err := row.Scan(&image.Url, &image.File, &image.Date, &image.CacheKey)
+	err := image.scanFrom(row)
 	if err != nil && err != sql.ErrNoRows {
 		slog.Error(err.Error())
 	}
@@ -102,54 +236,177 @@ func GetImage(url string) (*Image, error) {
 	return &image, err
 }
 
+// Filter for listing or deleting images. Empty fields are ignored.
+type ImageFilter struct {
+	// url prefix, e.g. "https://example.com/blog"
+	Prefix string
+	// domain of the url, matched for both http and https
+	Domain string
+	// cache key prefix, e.g. a template name
+	CacheKeyPrefix string
+}
+
+// returns the where clause and args for the filter
+func (f ImageFilter) where() (string, []any) {
+	var conditions []string
+	var args []any
+	if f.Prefix != "" {
+		conditions = append(conditions, `url LIKE ? ESCAPE '\'`)
+		args = append(args, escapeLike(f.Prefix)+"%")
+	}
+	if f.Domain != "" {
+		conditions = append(conditions, `(url IN (?, ?) OR url LIKE ? ESCAPE '\' OR url LIKE ? ESCAPE '\')`)
+		domain := escapeLike(f.Domain)
+		args = append(args, "http://"+f.Domain, "https://"+f.Domain, "http://"+domain+"/%", "https://"+domain+"/%")
+	}
+	if f.CacheKeyPrefix != "" {
+		conditions = append(conditions, `cache_key LIKE ? ESCAPE '\'`)
+		args = append(args, escapeLike(f.CacheKeyPrefix)+"%")
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// escapes LIKE wildcards so input is matched literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Returns images matching the filter ordered by url, along with the total number of matches
+func ListImages(filter ImageFilter, limit, offset int) (images []Image, total int, err error) {
+	where, args := filter.where()
+	if err = db.QueryRow(`SELECT COUNT(*) FROM images`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := db.Query(
+		`SELECT `+imageColumns+` FROM images`+where+` ORDER BY url LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	images = []Image{}
+	for rows.Next() {
+		var image Image
+		if err := image.scanFrom(rows); err != nil {
+			return nil, 0, err
+		}
+		images = append(images, image)
+	}
+	return images, total, rows.Err()
+}
+
+// Deletes an image row and its file. Returns sql.ErrNoRows if url is not in the database.
+func DeleteImage(url string) error {
+	n, err := DeleteImages(ImageFilter{}, url)
+	if err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+// Deletes images matching the filter (and exact urls if supplied) along with their files.
+// Returns the number of deleted rows.
+//
+// An empty filter with no urls deletes nothing.
+func DeleteImages(filter ImageFilter, urls ...string) (int, error) {
+	where, args := filter.where()
+	if len(urls) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(urls)), ",")
+		if where == "" {
+			where = " WHERE "
+		} else {
+			where += " AND "
+		}
+		where += "url IN (" + placeholders + ")"
+		for _, url := range urls {
+			args = append(args, url)
+		}
+	}
+	if where == "" {
+		return 0, nil
+	}
+	// delete rows first so a failure can't leave rows pointing to missing files
+	rows, err := db.Query(`DELETE FROM images`+where+` RETURNING file`, args...)
+	if err != nil {
+		return 0, err
+	}
+	var files []string
+	for rows.Next() {
+		var file string
+		if err := rows.Scan(&file); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		files = append(files, file)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	removeFiles(files)
+	slog.Debug("Deleted images", "count", len(files))
+	return len(files), nil
+}
+
+// removes image files, logging any errors
+func removeFiles(files []string) {
+	for _, file := range files {
+		if err := storage.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("Error removing image file", "file", file, "error", err)
+		}
+	}
+}
+
+// Returns the size of the image file in bytes
+func (img *Image) Size() (int64, error) {
+	info, err := storage.Stat(img.File)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
 // Cleans up expired database data by deleting rows and their corresponding files.
 //
-// It retrieves the expiration time from the environment variable "CACHE_TIME" or defaults to "30 days".
+// Images expire at their own expiry time if set, otherwise after CACHE_TIME,
+// which defaults to "30 days".
 //
 // Returns an error if there was a problem querying the database or deleting the files.
 func Clean() error {
 	slog.Debug("Cleaning expired database data")
-	cleanInterval := getCleanInterval()
-	// grab rows so we can delete the files
-	rows, err := db.Query(fmt.Sprintf(`SELECT file FROM images WHERE date <= DATETIME('now', '-%s');`, cleanInterval))
+	cutoff := fmt.Sprintf("-%d seconds", int64(getCacheTime().Seconds()))
+	// delete rows first so a failure can't leave rows pointing to missing files
+	rows, err := db.Query(
+		`DELETE FROM images WHERE
+			(expires IS NOT NULL AND expires <= DATETIME('now')) OR
+			(expires IS NULL AND date <= DATETIME('now', ?))
+		RETURNING file`,
+		cutoff,
+	)
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
 	files := []string{}
-	// loop rows to delete files
 	for rows.Next() {
 		var file string
 		if err := rows.Scan(&file); err != nil {
+			rows.Close()
 			return err
 		}
 		files = append(files, file)
 	}
-	// delete rows
-	_, err = db.Exec(
-		fmt.Sprintf(`DELETE FROM images WHERE date <= DATETIME('now', '-%s');`, cleanInterval),
-	)
-	if err != nil {
+	rows.Close()
+	if err := rows.Err(); err != nil {
 		return err
 	}
-	// delete files
-	for _, file := range files {
-		if err = os.Remove(filepath.Join(global.ImageDir, file)); err != nil {
-			return err
-		}
-	}
+	// errors are logged so one bad file doesn't leave the rest behind
+	removeFiles(files)
 	slog.Debug("Cleaned expired rows / images", "count", len(files))
-	return nil
-}
-
-// needed to add cache_key col between 0.0.3 and 0.0.4 releases
-//
-// move to init function on major release
-func runDatabaseUpdates() {
-	_, err := db.Exec(`ALTER TABLE images ADD COLUMN cache_key TEXT NOT NULL DEFAULT '';`)
-	if err != nil {
-		if !strings.Contains(err.Error(), "duplicate column") {
-			log.Fatal("Error adding cache_key column:", err)
-		}
-	}
+	// enforce size limits in case they were lowered
+	_, err = evict("")
+	return err
 }
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/config"
+	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/henrygd/social-image-server/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	dataDir, _ := os.MkdirTemp("", "social-image-server-database-test")
+	global.DatabaseDir = dataDir
+	global.ImageDir = dataDir
+	storage.Set(storage.NewFS(dataDir))
+	Init(config.Default())
+	code := m.Run()
+	os.RemoveAll(dataDir)
+	os.Exit(code)
+}
+
+// saves a file and adds its row to the database
+func addImage(t *testing.T, url string, size int) {
+	t.Helper()
+	file := filepath.Base(url) + ".jpg"
+	if err := storage.Save(file, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddImage(&Image{Url: url, File: file, FileSize: int64(size)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sets the last access time of an image relative to now
+func setLastAccess(url, modifier string) {
+	db.Exec(`UPDATE images SET last_access = DATETIME('now', ?) WHERE url = ?`, modifier, url)
+}
+
+func cachedUrls(t *testing.T) []string {
+	t.Helper()
+	images, _, err := ListImages(ImageFilter{Prefix: "https://evict.example.com/"}, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := []string{}
+	for _, img := range images {
+		urls = append(urls, img.Url)
+	}
+	return urls
+}
+
+func TestEvictByEntries(t *testing.T) {
+	defer DeleteImages(ImageFilter{Prefix: "https://evict.example.com/"})
+	defer SetCacheLimits(0, 0)
+	SetCacheLimits(0, 3)
+
+	for i := 1; i <= 3; i++ {
+		url := fmt.Sprintf("https://evict.example.com/%d", i)
+		addImage(t, url, 10)
+		setLastAccess(url, fmt.Sprintf("-%d hours", 10-i))
+	}
+	// serving the oldest image makes the second the least recently used
+	assert.NoError(t, TouchImage("https://evict.example.com/1"))
+
+	addImage(t, "https://evict.example.com/4", 10)
+	assert.Equal(t, []string{
+		"https://evict.example.com/1",
+		"https://evict.example.com/3",
+		"https://evict.example.com/4",
+	}, cachedUrls(t))
+	assert.NoFileExists(t, filepath.Join(global.ImageDir, "2.jpg"))
+}
+
+func TestEvictBySize(t *testing.T) {
+	defer DeleteImages(ImageFilter{Prefix: "https://evict.example.com/"})
+	defer SetCacheLimits(0, 0)
+
+	addImage(t, "https://evict.example.com/a", 100)
+	setLastAccess("https://evict.example.com/a", "-2 hours")
+	addImage(t, "https://evict.example.com/b", 100)
+	setLastAccess("https://evict.example.com/b", "-1 hours")
+	addImage(t, "https://evict.example.com/c", 100)
+
+	// lowered limit is applied during cleanup
+	SetCacheLimits(250, 0)
+	assert.NoError(t, Clean())
+	assert.Equal(t, []string{"https://evict.example.com/b", "https://evict.example.com/c"}, cachedUrls(t))
+
+	// new image is kept even if it alone exceeds the limit
+	addImage(t, "https://evict.example.com/d", 300)
+	assert.Equal(t, []string{"https://evict.example.com/d"}, cachedUrls(t))
+}
+
+func TestCleanUsesImageExpiry(t *testing.T) {
+	defer DeleteImages(ImageFilter{Prefix: "https://expiry.example.com/"})
+	defer SetCacheTime(30 * 24 * time.Hour)
+
+	// longer than CACHE_TIME
+	AddImage(&Image{Url: "https://expiry.example.com/long", File: "long.jpg", Expires: ExpiresIn(90 * 24 * time.Hour)})
+	// shorter than CACHE_TIME
+	AddImage(&Image{Url: "https://expiry.example.com/short", File: "short.jpg", Expires: ExpiresIn(-time.Minute)})
+	// uses CACHE_TIME
+	AddImage(&Image{Url: "https://expiry.example.com/default", File: "default.jpg"})
+	db.Exec(`UPDATE images SET date = DATETIME('now', '-2 hours') WHERE url LIKE 'https://expiry.example.com/%'`)
+
+	img, _ := GetImage("https://expiry.example.com/short")
+	assert.True(t, img.Expired())
+	img, _ = GetImage("https://expiry.example.com/default")
+	assert.False(t, img.Expired())
+	assert.Empty(t, img.Expires)
+
+	SetCacheTime(time.Hour)
+	assert.NoError(t, Clean())
+	images, _, _ := ListImages(ImageFilter{Prefix: "https://expiry.example.com/"}, 10, 0)
+	if assert.Len(t, images, 1) {
+		assert.Equal(t, "https://expiry.example.com/long", images[0].Url)
+		assert.False(t, images[0].Expired())
+	}
+}
@@ -0,0 +1,109 @@
+package database
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/storage"
+)
+
+// files newer than this may belong to an image that is still being added
+const orphanGracePeriod = 10 * time.Minute
+
+// matches the names of image files created by the server: random hex names,
+// or the numeric names of images created before storage backends
+var imageFileRegex = regexp.MustCompile(`^(?:[0-9a-f]{32}|[0-9]+)\.(?:jpg|png)$`)
+
+// Summary of a consistency check
+type FsckResult struct {
+	// files in storage not referenced by any row
+	OrphanFiles []string `json:"orphan_files"`
+	// urls of rows whose file is missing from storage
+	DanglingRows []string `json:"dangling_rows"`
+}
+
+// Reconciles the images table with storage. Deletes image files that no row
+// references and rows whose file is missing. Nothing is deleted if dryRun is true.
+//
+// Only files named like the server names them are orphans. Shared storage
+// may hold images of other servers, so its files are never orphans.
+func Fsck(dryRun bool) (*FsckResult, error) {
+	// list files before reading rows so a row added in between is never
+	// missing from the rows while its file is in the list
+	entries, err := storage.List()
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]storage.Entry, len(entries))
+	for _, entry := range entries {
+		stored[entry.Name] = entry
+	}
+
+	rows, err := db.Query(`SELECT url, file FROM images`)
+	if err != nil {
+		return nil, err
+	}
+	referenced := map[string]bool{}
+	var missing []Image
+	for rows.Next() {
+		var img Image
+		if err := rows.Scan(&img.Url, &img.File); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		name := path.Base(img.File)
+		referenced[name] = true
+		if _, ok := stored[name]; !ok {
+			missing = append(missing, img)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &FsckResult{OrphanFiles: []string{}, DanglingRows: []string{}}
+	for _, img := range missing {
+		// file may have been saved after listing
+		if _, err := storage.Stat(img.File); !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		result.DanglingRows = append(result.DanglingRows, img.Url)
+		if dryRun {
+			continue
+		}
+		// only delete the row if it still points to the missing file
+		if _, err := db.Exec(`DELETE FROM images WHERE url = ? AND file = ?`, img.Url, img.File); err != nil {
+			return nil, err
+		}
+	}
+	cutoff := time.Now().Add(-orphanGracePeriod)
+	shared := storage.IsShared()
+	for name, entry := range stored {
+		if shared || referenced[name] || !isImageFile(name) || entry.ModTime.After(cutoff) {
+			continue
+		}
+		result.OrphanFiles = append(result.OrphanFiles, name)
+		if !dryRun {
+			removeFiles([]string{name})
+		}
+	}
+
+	sort.Strings(result.OrphanFiles)
+
+	if len(result.OrphanFiles) > 0 || len(result.DanglingRows) > 0 {
+		slog.Info("Cache consistency check", "orphan_files", len(result.OrphanFiles), "dangling_rows", len(result.DanglingRows), "dry_run", dryRun)
+	}
+	return result, nil
+}
+
+// returns true for image files and temp files left by interrupted writes
+func isImageFile(name string) bool {
+	return strings.HasPrefix(name, ".tmp-") || imageFileRegex.MatchString(name)
+}
@@ -0,0 +1,83 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/henrygd/social-image-server/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFsck(t *testing.T) {
+	defer DeleteImages(ImageFilter{Prefix: "https://fsck.example.com/"})
+	old := time.Now().Add(-time.Hour)
+
+	addImage(t, "https://fsck.example.com/ok", 10)
+	addImage(t, "https://fsck.example.com/dangling", 10)
+	os.Remove(filepath.Join(global.ImageDir, "dangling.jpg"))
+	// orphans from an interrupted update and write, and files the server
+	// didn't create
+	orphan := "0123456789abcdef0123456789abcdef.jpg"
+	for _, name := range []string{orphan, "1234567.png", ".tmp-orphan", "logo.png"} {
+		storage.Save(name, []byte("orphan"))
+		os.Chtimes(filepath.Join(global.ImageDir, name), old, old)
+	}
+	defer storage.Remove("logo.png")
+	// may belong to an image that is still being added
+	storage.Save("recent.png", []byte("recent"))
+	defer storage.Remove("recent.png")
+
+	result, err := Fsck(true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{".tmp-orphan", orphan, "1234567.png"}, result.OrphanFiles)
+	assert.Equal(t, []string{"https://fsck.example.com/dangling"}, result.DanglingRows)
+	// dry run doesn't delete anything
+	assert.FileExists(t, filepath.Join(global.ImageDir, orphan))
+	_, err = GetImage("https://fsck.example.com/dangling")
+	assert.NoError(t, err)
+
+	result, err = Fsck(false)
+	assert.NoError(t, err)
+	assert.Len(t, result.OrphanFiles, 3)
+	assert.NoFileExists(t, filepath.Join(global.ImageDir, orphan))
+	assert.FileExists(t, filepath.Join(global.ImageDir, "logo.png"))
+	assert.NoFileExists(t, filepath.Join(global.ImageDir, ".tmp-orphan"))
+	assert.FileExists(t, filepath.Join(global.ImageDir, "recent.png"))
+	assert.FileExists(t, filepath.Join(global.ImageDir, "ok.jpg"))
+	// database file in the same directory is left alone
+	assert.FileExists(t, filepath.Join(global.ImageDir, "social-image-server.db"))
+	_, err = GetImage("https://fsck.example.com/dangling")
+	assert.Error(t, err)
+
+	result, _ = Fsck(false)
+	assert.Empty(t, result.OrphanFiles)
+	assert.Empty(t, result.DanglingRows)
+}
+
+// storage that other servers save images to
+type sharedStorage struct {
+	storage.Storage
+}
+
+func (sharedStorage) Shared() bool {
+	return true
+}
+
+func TestFsckSharedStorage(t *testing.T) {
+	defer storage.Set(storage.Get())
+	storage.Set(sharedStorage{storage.Get()})
+	// saved by another server using the same bucket
+	name := "fedcba9876543210fedcba9876543210.png"
+	storage.Save(name, []byte("other"))
+	defer storage.Remove(name)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(global.ImageDir, name), old, old)
+
+	result, err := Fsck(false)
+	assert.NoError(t, err)
+	assert.Empty(t, result.OrphanFiles)
+	assert.FileExists(t, filepath.Join(global.ImageDir, name))
+}
@@ -0,0 +1,96 @@
+package database
+
+import "database/sql"
+
+// Render job statuses
+const (
+	JobQueued   = "queued"
+	JobRunning  = "running"
+	JobFinished = "finished"
+	JobFailed   = "failed"
+)
+
+// Asynchronous render job
+type Job struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	ImageUrl    string `json:"image_url"`
+	CallbackUrl string `json:"callback_url,omitempty"`
+	Force       bool   `json:"force"`
+	Error       string `json:"error,omitempty"`
+	Created     string `json:"created"`
+	Updated     string `json:"updated"`
+}
+
+const jobColumns = `id, status, image_url, callback_url, force, error, created, updated`
+
+func scanJob(row interface{ Scan(...any) error }) (*Job, error) {
+	var job Job
+	err := row.Scan(&job.ID, &job.Status, &job.ImageUrl, &job.CallbackUrl, &job.Force, &job.Error, &job.Created, &job.Updated)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Adds a queued job to the database
+func AddJob(id, imageUrl, callbackUrl string, force bool) (*Job, error) {
+	_, err := db.Exec(
+		`INSERT INTO jobs (id, status, image_url, callback_url, force) VALUES (?, ?, ?, ?, ?)`,
+		id, JobQueued, imageUrl, callbackUrl, force,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return GetJob(id)
+}
+
+// Returns the job with the given id. Returns sql.ErrNoRows if it doesn't exist.
+func GetJob(id string) (*Job, error) {
+	return scanJob(db.QueryRow(`SELECT `+jobColumns+` FROM jobs WHERE id = ?`, id))
+}
+
+// Sets the status and error message of a job
+func UpdateJob(id, status, errMsg string) error {
+	result, err := db.Exec(
+		`UPDATE jobs SET status = ?, error = ?, updated = CURRENT_TIMESTAMP WHERE id = ?`,
+		status, errMsg, id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Returns jobs that are queued or were running when the server stopped, oldest first
+func UnfinishedJobs() ([]*Job, error) {
+	rows, err := db.Query(
+		`SELECT `+jobColumns+` FROM jobs WHERE status IN (?, ?) ORDER BY created, rowid`,
+		JobQueued, JobRunning,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var jobs []*Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// Deletes finished and failed jobs last updated before the sqlite datetime modifier, e.g. "-7 days"
+func CleanJobs(modifier string) error {
+	_, err := db.Exec(
+		`DELETE FROM jobs WHERE status IN (?, ?) AND updated <= DATETIME('now', ?)`,
+		JobFinished, JobFailed, modifier,
+	)
+	return err
+}
@@ -0,0 +1,262 @@
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/henrygd/social-image-server/internal/storage"
+)
+
+// Schema change applied once, in order of version. Migrations must be safe
+// to run against databases created before the migrations table existed.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// Add new migrations to the end. Never change or reorder released migrations.
+var migrations = []migration{
+	{1, "create images table", func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`CREATE TABLE IF NOT EXISTS images (
+				url TEXT NOT NULL PRIMARY KEY,
+				file TEXT NOT NULL,
+				date DATETIME DEFAULT CURRENT_TIMESTAMP
+			);
+			CREATE INDEX IF NOT EXISTS url_index ON images (url);`,
+		)
+		return err
+	}},
+	{2, "add images.cache_key", func(tx *sql.Tx) error {
+		return addColumn(tx, "images", "cache_key", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{3, "create jobs table", func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`CREATE TABLE IF NOT EXISTS jobs (
+				id TEXT NOT NULL PRIMARY KEY,
+				status TEXT NOT NULL,
+				image_url TEXT NOT NULL,
+				callback_url TEXT NOT NULL DEFAULT '',
+				force INTEGER NOT NULL DEFAULT 0,
+				error TEXT NOT NULL DEFAULT '',
+				created DATETIME DEFAULT CURRENT_TIMESTAMP,
+				updated DATETIME DEFAULT CURRENT_TIMESTAMP
+			)`,
+		)
+		return err
+	}},
+	{4, "add images.last_access and images.size", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "images", "last_access", "DATETIME"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "images", "size", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		return backfillSizes(tx)
+	}},
+	{5, "add images.expires", func(tx *sql.Tx) error {
+		return addColumn(tx, "images", "expires", "DATETIME")
+	}},
+	{6, "add images.hash", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "images", "hash", "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+		return backfillHashes(tx)
+	}},
+}
+
+// Applied state of a migration
+type MigrationStatus struct {
+	Version int
+	Name    string
+	// empty if the migration is pending
+	Applied string
+}
+
+// Applies pending migrations to the database
+func Migrate() error {
+	return migrate(db)
+}
+
+// Returns the status of all known migrations
+func Migrations() ([]MigrationStatus, error) {
+	return migrationStatus(db)
+}
+
+func createMigrationsTable(conn *sql.DB) error {
+	_, err := conn.Exec(
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER NOT NULL PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+	)
+	return err
+}
+
+// returns applied migration versions mapped to when they were applied
+func appliedMigrations(conn *sql.DB) (map[int]string, error) {
+	applied := map[int]string{}
+	// migrations table doesn't exist until the first migration
+	var exists int
+	if err := conn.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'`).Scan(&exists); err != nil || exists == 0 {
+		return applied, err
+	}
+	rows, err := conn.Query(`SELECT version, applied FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var date string
+		if err := rows.Scan(&version, &date); err != nil {
+			return nil, err
+		}
+		applied[version] = date
+	}
+	return applied, rows.Err()
+}
+
+func migrate(conn *sql.DB) error {
+	if err := createMigrationsTable(conn); err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(conn)
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].version
+	for version := range applied {
+		if version > latest {
+			return fmt.Errorf("database schema version %d is newer than this release (%d)", version, latest)
+		}
+	}
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		slog.Debug("Applying migration", "version", m.version, "name", m.name)
+		if err := applyMigration(conn, m); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+// runs the migration and records it in a single transaction
+func applyMigration(conn *sql.DB, m migration) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.version, m.name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrationStatus(conn *sql.DB) ([]MigrationStatus, error) {
+	applied, err := appliedMigrations(conn)
+	if err != nil {
+		return nil, err
+	}
+	status := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		status[i] = MigrationStatus{Version: m.version, Name: m.name, Applied: applied[m.version]}
+	}
+	return status, nil
+}
+
+// adds a column if the table doesn't already have it
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	var exists int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&exists)
+	if err != nil || exists > 0 {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+	return err
+}
+
+// sets the content hash of images cached before the hash column existed
+func backfillHashes(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT url, file FROM images WHERE hash = ''`)
+	if err != nil {
+		return err
+	}
+	hashes := map[string]string{}
+	for rows.Next() {
+		var url, file string
+		if err := rows.Scan(&url, &file); err != nil {
+			rows.Close()
+			return err
+		}
+		// missing files keep an empty hash
+		if hash, err := hashFile(file); err == nil {
+			hashes[url] = hash
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for url, hash := range hashes {
+		if _, err := tx.Exec(`UPDATE images SET hash = ? WHERE url = ?`, hash, url); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hashFile(file string) (string, error) {
+	f, _, err := storage.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sets the size of images cached before the size column existed
+func backfillSizes(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT url, file FROM images WHERE size = 0`)
+	if err != nil {
+		return err
+	}
+	sizes := map[string]int64{}
+	for rows.Next() {
+		var url, file string
+		if err := rows.Scan(&url, &file); err != nil {
+			rows.Close()
+			return err
+		}
+		// missing files keep a size of zero
+		if info, err := storage.Stat(file); err == nil {
+			sizes[url] = info.Size
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for url, size := range sizes {
+		if _, err := tx.Exec(`UPDATE images SET size = ? WHERE url = ?`, size, url); err != nil {
+			return err
+		}
+	}
+	return nil
+}
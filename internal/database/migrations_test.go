@@ -0,0 +1,135 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/henrygd/social-image-server/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// schema created by the 0.1.0 release
+const schemaV010 = `
+	CREATE TABLE images (
+		url TEXT NOT NULL PRIMARY KEY,
+		file TEXT NOT NULL,
+		date DATETIME DEFAULT CURRENT_TIMESTAMP,
+		cache_key TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX url_index ON images (url);
+	INSERT INTO images (url, file, cache_key) VALUES
+		('https://old.example.com/a', '/old-a.jpg', 'url=a'),
+		('https://old.example.com/missing', '/old-missing.jpg', 'url=missing');
+`
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	conn, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetMaxOpenConns(1)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func columns(t *testing.T, conn *sql.DB, table string) []string {
+	t.Helper()
+	rows, err := conn.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestMigrateFromV010(t *testing.T) {
+	conn := openTestDB(t)
+	if _, err := conn.Exec(schemaV010); err != nil {
+		t.Fatal(err)
+	}
+	storage.Save("old-a.jpg", []byte("twelve bytes"))
+	defer storage.Remove("old-a.jpg")
+
+	status, err := migrationStatus(conn)
+	assert.NoError(t, err)
+	for _, m := range status {
+		assert.Empty(t, m.Applied, "version %d", m.Version)
+	}
+
+	assert.NoError(t, migrate(conn))
+	assert.Equal(t,
+		[]string{"url", "file", "date", "cache_key", "last_access", "size", "expires", "hash"},
+		columns(t, conn, "images"),
+	)
+	assert.Contains(t, columns(t, conn, "jobs"), "callback_url")
+
+	// existing rows are kept and sizes are filled in from storage
+	var cacheKey string
+	var size int64
+	conn.QueryRow(`SELECT cache_key, size FROM images WHERE url = 'https://old.example.com/a'`).Scan(&cacheKey, &size)
+	assert.Equal(t, "url=a", cacheKey)
+	assert.Equal(t, int64(12), size)
+	var hash string
+	conn.QueryRow(`SELECT hash FROM images WHERE url = 'https://old.example.com/a'`).Scan(&hash)
+	// sha256 of "twelve bytes"
+	assert.Equal(t, "d4ce2c527afe674c7a086bd74e256019e3d5dcdb31eeb6eaadef5ada8c4383b9", hash)
+	conn.QueryRow(`SELECT size FROM images WHERE url = 'https://old.example.com/missing'`).Scan(&size)
+	assert.Equal(t, int64(0), size)
+
+	status, err = migrationStatus(conn)
+	assert.NoError(t, err)
+	assert.Len(t, status, len(migrations))
+	for _, m := range status {
+		assert.NotEmpty(t, m.Applied, "version %d", m.Version)
+	}
+
+	// running again is a no-op
+	assert.NoError(t, migrate(conn))
+	var count int
+	conn.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&count)
+	assert.Equal(t, len(migrations), count)
+}
+
+func TestMigrateEmptyDatabase(t *testing.T) {
+	conn := openTestDB(t)
+	assert.NoError(t, migrate(conn))
+	assert.Equal(t,
+		[]string{"url", "file", "date", "cache_key", "last_access", "size", "expires", "hash"},
+		columns(t, conn, "images"),
+	)
+}
+
+func TestFailedMigrationIsRolledBack(t *testing.T) {
+	conn := openTestDB(t)
+	assert.NoError(t, migrate(conn))
+
+	original := migrations
+	defer func() { migrations = original }()
+	migrations = append(migrations[:len(migrations):len(migrations)], migration{99, "broken", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "images", "broken", "TEXT"); err != nil {
+			return err
+		}
+		return errors.New("oops")
+	}})
+
+	assert.ErrorContains(t, migrate(conn), "migration 99 (broken): oops")
+	assert.NotContains(t, columns(t, conn, "images"), "broken")
+	status, _ := migrationStatus(conn)
+	assert.Empty(t, status[len(status)-1].Applied)
+}
+
+func TestMigrateRejectsNewerDatabase(t *testing.T) {
+	conn := openTestDB(t)
+	assert.NoError(t, migrate(conn))
+	conn.Exec(`INSERT INTO schema_migrations (version, name) VALUES (1000, 'from the future')`)
+	assert.ErrorContains(t, migrate(conn), "database schema version 1000 is newer")
+}
@@ -0,0 +1,94 @@
+package database
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+)
+
+// Standalone copy of the database used for backups
+type Snapshot struct {
+	conn *sql.DB
+}
+
+// Writes a consistent copy of the database to path and opens it.
+// Safe to call while the server is running.
+func CreateSnapshot(path string) (*Snapshot, error) {
+	if _, err := db.Exec(`VACUUM INTO ?`, path); err != nil {
+		return nil, err
+	}
+	return OpenSnapshot(path)
+}
+
+// Opens a database copy, migrating it to the current schema
+func OpenSnapshot(path string) (*Snapshot, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetMaxOpenConns(1)
+	if err := migrate(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Snapshot{conn: conn}, nil
+}
+
+// Returns all images in the snapshot
+func (s *Snapshot) Images() ([]Image, error) {
+	rows, err := s.conn.Query(`SELECT ` + imageColumns + ` FROM images ORDER BY url`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	images := []Image{}
+	for rows.Next() {
+		var image Image
+		if err := image.scanFrom(rows); err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	return images, rows.Err()
+}
+
+// Deletes an image row from the snapshot. Files are not touched.
+func (s *Snapshot) DeleteImage(url string) error {
+	_, err := s.conn.Exec(`DELETE FROM images WHERE url = ?`, url)
+	return err
+}
+
+func (s *Snapshot) Close() error {
+	return s.conn.Close()
+}
+
+// Adds an image from a backup, keeping its dates. Replaces an existing
+// image with the same url and removes its file if it differs.
+func RestoreImage(img *Image) error {
+	var oldFile string
+	err := db.QueryRow(`SELECT file FROM images WHERE url = ?`, img.Url).Scan(&oldFile)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	// DATETIME normalizes RFC3339 values returned by the driver
+	_, err = db.Exec(
+		`INSERT OR REPLACE INTO images (url, file, cache_key, size, hash, date, last_access, expires)
+		VALUES (?, ?, ?, ?, ?, DATETIME(?), DATETIME(NULLIF(?, '')), DATETIME(NULLIF(?, '')))`,
+		img.Url, img.File, img.CacheKey, img.FileSize, img.Hash, img.Date, img.LastAccess, img.Expires,
+	)
+	if err != nil {
+		return err
+	}
+	if oldFile != "" && cleanFileName(oldFile) != cleanFileName(img.File) {
+		removeFiles([]string{oldFile})
+	}
+	return nil
+}
+
+// strips the leading slash stored with images created before storage backends
+func cleanFileName(file string) string {
+	return strings.TrimPrefix(file, "/")
+}
@@ -6,14 +6,21 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
-	"strconv"
+	"sync"
+
+	"github.com/henrygd/social-image-server/internal/config"
+	"github.com/henrygd/social-image-server/internal/profile"
 )
 
 var DatabaseDir string
 var ImageDir string
 var TemplateDir string
+var ProxyDir string
+var FontDir string
 var RegenKey string
-var AllowedDomainsMap map[string]bool
+
+var allowedDomainsMap map[string]bool
+var allowedDomainsLock sync.RWMutex
 
 var ImageOptions = struct {
 	Format    string
@@ -33,17 +40,16 @@ type ReqData struct {
 	CacheKey     string
 	Params       url.Values
 	Template     string
+	Profile      *profile.Profile
 }
 
-func Init() (dataDir string) {
-	dataDir = os.Getenv("DATA_DIR")
-	if dataDir == "" {
-		dataDir = "./data"
-	}
-	slog.Debug("DATA_DIR", "value", dataDir)
-	DatabaseDir = filepath.Join(dataDir, "db")
-	ImageDir = filepath.Join(dataDir, "images")
-	TemplateDir = filepath.Join(dataDir, "templates")
+func Init(cfg *config.Config) {
+	slog.Debug("DATA_DIR", "value", cfg.DataDir)
+	DatabaseDir = filepath.Join(cfg.DataDir, "db")
+	ImageDir = filepath.Join(cfg.DataDir, "images")
+	TemplateDir = filepath.Join(cfg.DataDir, "templates")
+	ProxyDir = filepath.Join(cfg.DataDir, "proxy")
+	FontDir = filepath.Join(cfg.DataDir, "fonts")
 
 	// create folders
 	if err := os.MkdirAll(DatabaseDir, 0755); err != nil {
@@ -55,31 +61,45 @@ func Init() (dataDir string) {
 	if err := os.MkdirAll(TemplateDir, 0755); err != nil {
 		log.Fatal(err)
 	}
-	// set image format
-	if os.Getenv("IMG_FORMAT") == "png" {
-		ImageOptions.Format = "png"
-		ImageOptions.Extension = ".png"
+	if err := os.MkdirAll(ProxyDir, 0755); err != nil {
+		log.Fatal(err)
 	}
-	// set image width
-	if width, ok := os.LookupEnv("IMG_WIDTH"); ok {
-		var err error
-		ImageOptions.Width, err = strconv.ParseFloat(width, 64)
-		if err != nil || ImageOptions.Width < 1000 || ImageOptions.Width > 2500 {
-			slog.Error("Invalid IMG_WIDTH", "value", width, "min", 1000, "max", 2500)
-			os.Exit(1)
-		}
+	if err := os.MkdirAll(FontDir, 0755); err != nil {
+		log.Fatal(err)
 	}
-	// set image quality
-	if quality, ok := os.LookupEnv("IMG_QUALITY"); ok {
-		var err error
-		ImageOptions.Quality, err = strconv.ParseInt(quality, 10, 64)
-		if err != nil || ImageOptions.Quality < 1 || ImageOptions.Quality > 100 {
-			slog.Error("Invalid IMG_QUALITY", "value", quality, "min", 1, "max", 100)
-			os.Exit(1)
-		}
+	// set image options
+	ImageOptions.Format = cfg.ImgFormat
+	ImageOptions.Extension = ".jpg"
+	if cfg.ImgFormat == "png" {
+		ImageOptions.Extension = ".png"
 	}
+	ImageOptions.Width = cfg.ImgWidth
+	ImageOptions.Quality = cfg.ImgQuality
 	// set regen key
-	RegenKey = os.Getenv("REGEN_KEY")
+	RegenKey = cfg.RegenKey
+
+	SetAllowedDomains(cfg.AllowedDomains)
+}
+
+// Sets the domains allowed in the url param. All domains are allowed if empty.
+func SetAllowedDomains(domains []string) {
+	allowedDomainsLock.Lock()
+	defer allowedDomainsLock.Unlock()
+	if len(domains) == 0 {
+		allowedDomainsMap = nil
+		return
+	}
+	slog.Debug("ALLOWED_DOMAINS", "value", domains)
+	// create map of allowed domains for quick lookup
+	allowedDomainsMap = make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		allowedDomainsMap[domain] = true
+	}
+}
 
-	return dataDir
+// Checks if a domain is allowed in the url param
+func IsAllowedDomain(domain string) bool {
+	allowedDomainsLock.RLock()
+	defer allowedDomainsLock.RUnlock()
+	return allowedDomainsMap == nil || allowedDomainsMap[domain]
 }
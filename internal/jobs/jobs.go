@@ -0,0 +1,169 @@
+package jobs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/database"
+	"github.com/henrygd/social-image-server/internal/scraper"
+)
+
+// Renders the image for an og:image url pointing at this server.
+// Cached images are only regenerated if force is true.
+type RenderFunc func(imageURL *url.URL, force bool) error
+
+// delays between webhook delivery attempts
+var webhookRetryDelays = []time.Duration{time.Second, 5 * time.Second, 30 * time.Second}
+
+// Returned by Submit if the callback url is not a valid http(s) url
+var ErrInvalidCallback = errors.New("invalid callback_url")
+
+var queue = make(chan string, 1000)
+var startOnce sync.Once
+var webhookSecret string
+
+// Starts workers that process queued jobs and requeues jobs left
+// unfinished by a previous run. Only the first call has any effect.
+func Start(workers int, secret string, render RenderFunc) {
+	startOnce.Do(func() {
+		webhookSecret = secret
+		for i := 0; i < workers; i++ {
+			go worker(render)
+		}
+		unfinished, err := database.UnfinishedJobs()
+		if err != nil {
+			slog.Error("Error loading unfinished jobs", "error", err)
+			return
+		}
+		for _, job := range unfinished {
+			slog.Debug("Requeueing job", "id", job.ID)
+			enqueue(job.ID)
+		}
+	})
+}
+
+// Validates and adds a job to the queue
+func Submit(imageURL, callbackURL string, force bool) (*database.Job, error) {
+	if callbackURL != "" {
+		if u, err := url.Parse(callbackURL); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, ErrInvalidCallback
+		}
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	job, err := database.AddJob(hex.EncodeToString(id), imageURL, callbackURL, force)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("Job queued", "id", job.ID, "image_url", imageURL)
+	enqueue(job.ID)
+	return job, nil
+}
+
+// adds a job id to the queue without blocking the caller
+func enqueue(id string) {
+	select {
+	case queue <- id:
+	default:
+		go func() { queue <- id }()
+	}
+}
+
+func worker(render RenderFunc) {
+	for id := range queue {
+		job, err := database.GetJob(id)
+		if err != nil {
+			slog.Error("Error loading job", "id", id, "error", err)
+			continue
+		}
+		run(job, render)
+	}
+}
+
+// renders the job's image and sends the webhook callback
+func run(job *database.Job, render RenderFunc) {
+	if err := database.UpdateJob(job.ID, database.JobRunning, ""); err != nil {
+		slog.Error("Error updating job", "id", job.ID, "error", err)
+		return
+	}
+	status, errMsg := database.JobFinished, ""
+	imageURL, err := url.Parse(job.ImageUrl)
+	if err == nil {
+		err = render(imageURL, job.Force)
+	}
+	if err != nil {
+		status, errMsg = database.JobFailed, err.Error()
+		slog.Error("Job failed", "id", job.ID, "error", err)
+	} else {
+		slog.Debug("Job finished", "id", job.ID)
+	}
+	if err := database.UpdateJob(job.ID, status, errMsg); err != nil {
+		slog.Error("Error updating job", "id", job.ID, "error", err)
+		return
+	}
+	if job.CallbackUrl != "" {
+		if job, err = database.GetJob(job.ID); err == nil {
+			sendWebhook(job)
+		}
+	}
+}
+
+// posts the job to its callback url, retrying on failure
+func sendWebhook(job *database.Job) {
+	body, _ := json.Marshal(job)
+	for attempt := 0; ; attempt++ {
+		err := postWebhook(job.CallbackUrl, body)
+		if err == nil {
+			slog.Debug("Webhook delivered", "id", job.ID, "url", job.CallbackUrl)
+			return
+		}
+		if attempt >= len(webhookRetryDelays) {
+			slog.Error("Webhook failed", "id", job.ID, "url", job.CallbackUrl, "error", err)
+			return
+		}
+		time.Sleep(webhookRetryDelays[attempt])
+	}
+}
+
+func postWebhook(callbackURL string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Og-Timestamp", timestamp)
+	if webhookSecret != "" {
+		req.Header.Set("X-Og-Signature", Sign(webhookSecret, timestamp, body))
+	}
+	resp, err := scraper.GetClient().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Returns the signature header value for a webhook body:
+// "sha256=" followed by the hex HMAC-SHA256 of "{timestamp}.{body}"
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,115 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/config"
+	"github.com/henrygd/social-image-server/internal/database"
+	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/henrygd/social-image-server/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	dataDir, _ := os.MkdirTemp("", "social-image-server-jobs-test")
+	global.DatabaseDir = dataDir
+	global.ImageDir = dataDir
+	storage.Set(storage.NewFS(dataDir))
+	database.Init(config.Default())
+	webhookRetryDelays = []time.Duration{10 * time.Millisecond}
+	code := m.Run()
+	os.RemoveAll(dataDir)
+	os.Exit(code)
+}
+
+func TestSubmitValidatesCallback(t *testing.T) {
+	_, err := Submit("/capture?url=example.com", "ftp://example.com/hook", false)
+	assert.ErrorIs(t, err, ErrInvalidCallback)
+}
+
+func TestRunWithSignedWebhook(t *testing.T) {
+	webhookSecret = "tonybenn"
+	defer func() { webhookSecret = "" }()
+
+	received := make(chan *http.Request, 2)
+	bodies := make(chan []byte, 2)
+	attempts := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		// first delivery fails to test retries
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer hook.Close()
+
+	job, err := database.AddJob("signed-job", "/capture?url=example.com&force=1", hook.URL, true)
+	assert.NoError(t, err)
+
+	var renderedURL *url.URL
+	var renderedForce bool
+	run(job, func(imageURL *url.URL, force bool) error {
+		renderedURL, renderedForce = imageURL, force
+		return nil
+	})
+
+	assert.Equal(t, "/capture", renderedURL.Path)
+	assert.True(t, renderedForce)
+
+	req, body := <-received, <-bodies
+	assert.Equal(t, 2, attempts)
+	timestamp := req.Header.Get("X-Og-Timestamp")
+	assert.Equal(t, Sign("tonybenn", timestamp, body), req.Header.Get("X-Og-Signature"))
+
+	var delivered database.Job
+	json.Unmarshal(body, &delivered)
+	assert.Equal(t, "signed-job", delivered.ID)
+	assert.Equal(t, database.JobFinished, delivered.Status)
+
+	stored, _ := database.GetJob("signed-job")
+	assert.Equal(t, database.JobFinished, stored.Status)
+}
+
+func TestRunFailure(t *testing.T) {
+	job, _ := database.AddJob("failed-job", "/capture?url=example.com", "", false)
+	run(job, func(imageURL *url.URL, force bool) error {
+		assert.False(t, force)
+		return errors.New("browser on fire")
+	})
+	stored, _ := database.GetJob("failed-job")
+	assert.Equal(t, database.JobFailed, stored.Status)
+	assert.Equal(t, "browser on fire", stored.Error)
+}
+
+func TestStartRequeuesUnfinishedJobs(t *testing.T) {
+	database.AddJob("queued-job", "/capture?url=example.com", "", false)
+	database.UpdateJob("queued-job", database.JobRunning, "")
+
+	rendered := make(chan string, 1)
+	Start(1, "", func(imageURL *url.URL, force bool) error {
+		rendered <- imageURL.String()
+		return nil
+	})
+	select {
+	case u := <-rendered:
+		assert.Equal(t, "/capture?url=example.com", u)
+	case <-time.After(5 * time.Second):
+		t.Fatal("job was not requeued")
+	}
+	assert.Eventually(t, func() bool {
+		job, _ := database.GetJob("queued-job")
+		return job.Status == database.JobFinished
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,61 @@
+package profile
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// bounds for CACHE_TIME and profile cache times
+const (
+	MinCacheTime = time.Hour
+	MaxCacheTime = 10 * 365 * 24 * time.Hour
+)
+
+// matches cache times like "30 days" or "1 hour"
+var cacheTimeRegex = regexp.MustCompile(`^(\d+) ?(second|minute|hour|day|week|month|year)s?$`)
+
+var cacheTimeUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+	"month":  30 * 24 * time.Hour,
+	"year":   365 * 24 * time.Hour,
+}
+
+// Parses a cache time in Go duration syntax ("720h") or as a count
+// of units ("30 days"). Months are 30 days and years are 365 days.
+func ParseCacheTime(value string) (time.Duration, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if match := cacheTimeRegex.FindStringSubmatch(value); match != nil {
+		n, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil || n > math.MaxInt64/int64(cacheTimeUnits[match[2]]) {
+			return 0, fmt.Errorf("cache time %q is out of range", value)
+		}
+		return time.Duration(n) * cacheTimeUnits[match[2]], nil
+	}
+	return time.ParseDuration(value)
+}
+
+// Cache lifetime of a profile, written like CACHE_TIME ("14 days" or "336h")
+type CacheTime time.Duration
+
+func (c *CacheTime) UnmarshalYAML(node *yaml.Node) error {
+	var value string
+	if err := node.Decode(&value); err != nil {
+		return err
+	}
+	d, err := ParseCacheTime(value)
+	if err != nil {
+		return fmt.Errorf("invalid cache_time %q (examples: \"14 days\", \"336h\")", value)
+	}
+	*c = CacheTime(d)
+	return nil
+}
@@ -0,0 +1,170 @@
+package profile
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// key of the profile used for domains without their own profile
+const DefaultKey = "*"
+
+// url params that control rendering and can be restricted by a profile.
+// template params (title, etc.) are always passed through.
+var RenderParams = []string{"width", "format", "delay", "dark", "reduced_motion", "mobile", "locale", "timezone", "device_scale"}
+
+// Render settings for a domain
+type Profile struct {
+	Width     int64     `yaml:"width"`
+	Format    string    `yaml:"format"`
+	Quality   int64     `yaml:"quality"`
+	Delay     int64     `yaml:"delay"`
+	Dark      bool      `yaml:"dark"`
+	CSS       string    `yaml:"css"`
+	CacheTime CacheTime `yaml:"cache_time"`
+	// static image served when FALLBACK includes "image"
+	FallbackImage string `yaml:"fallback_image"`
+	// templates the domain may use. all templates are allowed if empty.
+	Templates []string `yaml:"templates"`
+	// render params that requests may override. all are allowed if nil.
+	Overrides []string `yaml:"overrides"`
+}
+
+var profiles map[string]*Profile
+var profilesLock sync.RWMutex
+
+// Loads profiles from a yaml file mapping domains to profiles
+func Load(path string) (map[string]*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var loaded map[string]*Profile
+	if err := yaml.Unmarshal(data, &loaded); err != nil {
+		return nil, err
+	}
+	var errs []error
+	for domain, p := range loaded {
+		if p == nil {
+			loaded[domain] = &Profile{}
+			continue
+		}
+		if err := p.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("profile %s: %w", domain, err))
+		}
+	}
+	return loaded, errors.Join(errs...)
+}
+
+// Sets the active profiles
+func Set(p map[string]*Profile) {
+	profilesLock.Lock()
+	defer profilesLock.Unlock()
+	profiles = p
+}
+
+// Returns the profile for a host, falling back to the default profile.
+// Returns nil if neither exists.
+func Get(host string) *Profile {
+	profilesLock.RLock()
+	defer profilesLock.RUnlock()
+	if p, ok := profiles[host]; ok {
+		return p
+	}
+	return profiles[DefaultKey]
+}
+
+// Checks profile values and returns all errors found
+func (p *Profile) Validate() error {
+	var errs []error
+	if p.Width != 0 && (p.Width < 400 || p.Width > 2400) {
+		errs = append(errs, fmt.Errorf("invalid width %d (min 400, max 2400)", p.Width))
+	}
+	if p.Format != "" && p.Format != "jpeg" && p.Format != "png" {
+		errs = append(errs, fmt.Errorf("invalid format %q (jpeg, png)", p.Format))
+	}
+	if p.Quality < 0 || p.Quality > 100 {
+		errs = append(errs, fmt.Errorf("invalid quality %d (min 1, max 100)", p.Quality))
+	}
+	if p.Delay < 0 || p.Delay > 10000 {
+		errs = append(errs, fmt.Errorf("invalid delay %d (min 0, max 10000)", p.Delay))
+	}
+	if d := time.Duration(p.CacheTime); d != 0 && (d < MinCacheTime || d > MaxCacheTime) {
+		errs = append(errs, fmt.Errorf("invalid cache_time %s (min 1 hour, max 10 years)", d))
+	}
+	if p.FallbackImage != "" {
+		if ext := strings.ToLower(filepath.Ext(p.FallbackImage)); ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
+			errs = append(errs, fmt.Errorf("invalid fallback_image %q (jpeg or png file)", p.FallbackImage))
+		} else if _, err := os.Stat(p.FallbackImage); err != nil {
+			errs = append(errs, fmt.Errorf("invalid fallback_image: %w", err))
+		}
+	}
+	for _, param := range p.Overrides {
+		if !slices.Contains(RenderParams, param) {
+			errs = append(errs, fmt.Errorf("unknown override %q", param))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Checks if a request param may override the profile
+func (p *Profile) CanOverride(param string) bool {
+	return p == nil || p.Overrides == nil || slices.Contains(p.Overrides, param)
+}
+
+// Checks if the profile allows a template
+func (p *Profile) AllowsTemplate(name string) bool {
+	return p == nil || len(p.Templates) == 0 || slices.Contains(p.Templates, name)
+}
+
+// Returns a copy of params with render params the profile doesn't let
+// requests override removed
+func (p *Profile) Filter(params url.Values) url.Values {
+	if p == nil {
+		return params
+	}
+	filtered := make(url.Values, len(params))
+	for key, values := range params {
+		if slices.Contains(RenderParams, key) && !p.CanOverride(key) {
+			continue
+		}
+		filtered[key] = values
+	}
+	return filtered
+}
+
+// Returns a copy of params with restricted render params removed
+// and profile defaults applied
+func (p *Profile) Apply(params url.Values) url.Values {
+	if p == nil {
+		return params
+	}
+	applied := p.Filter(params)
+	setDefault := func(key, value string) {
+		if !applied.Has(key) {
+			applied.Set(key, value)
+		}
+	}
+	if p.Width != 0 {
+		setDefault("width", strconv.FormatInt(p.Width, 10))
+	}
+	if p.Format != "" {
+		setDefault("format", p.Format)
+	}
+	if p.Delay != 0 {
+		setDefault("delay", strconv.FormatInt(p.Delay, 10))
+	}
+	if p.Dark {
+		setDefault("dark", "true")
+	}
+	return applied
+}
@@ -0,0 +1,114 @@
+package profile_test
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/profile"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeProfiles(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "profiles.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeProfiles(t, `
+"*":
+  width: 1400
+example.com:
+  width: 1200
+  format: png
+  quality: 80
+  cache_time: 48h
+  templates: [blog]
+  overrides: [delay]
+empty.com:
+`)
+	profiles, err := profile.Load(path)
+	assert.NoError(t, err)
+	assert.Len(t, profiles, 3)
+	assert.Equal(t, int64(1200), profiles["example.com"].Width)
+	assert.Equal(t, profile.CacheTime(48*time.Hour), profiles["example.com"].CacheTime)
+	assert.NotNil(t, profiles["empty.com"])
+
+	profile.Set(profiles)
+	defer profile.Set(nil)
+	assert.Equal(t, profiles["example.com"], profile.Get("example.com"))
+	assert.Equal(t, profiles["*"], profile.Get("other.com"))
+}
+
+func TestLoadReportsAllErrors(t *testing.T) {
+	path := writeProfiles(t, `
+example.com:
+  width: 10
+  format: webp
+  overrides: [width, nope]
+  fallback_image: fallback.gif
+`)
+	_, err := profile.Load(path)
+	assert.ErrorContains(t, err, "invalid width")
+	assert.ErrorContains(t, err, "invalid format")
+	assert.ErrorContains(t, err, `unknown override "nope"`)
+	assert.ErrorContains(t, err, "invalid fallback_image")
+}
+
+func TestLoadCacheTime(t *testing.T) {
+	// cache times are written like CACHE_TIME
+	profiles, err := profile.Load(writeProfiles(t, `
+example.com:
+  cache_time: 14 days
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, profile.CacheTime(14*24*time.Hour), profiles["example.com"].CacheTime)
+
+	// and have the same bounds
+	for value, msg := range map[string]string{
+		"30m":      "invalid cache_time 30m0s (min 1 hour, max 10 years)",
+		"20 years": "invalid cache_time 175200h0m0s (min 1 hour, max 10 years)",
+		"-1h":      "invalid cache_time -1h0m0s",
+		"soon":     `invalid cache_time "soon"`,
+	} {
+		_, err := profile.Load(writeProfiles(t, "example.com:\n  cache_time: "+value+"\n"))
+		assert.ErrorContains(t, err, msg, value)
+	}
+}
+
+func TestGetWithoutProfiles(t *testing.T) {
+	profile.Set(nil)
+	p := profile.Get("example.com")
+	assert.Nil(t, p)
+	// nil profile allows everything
+	assert.True(t, p.AllowsTemplate("anything"))
+	assert.True(t, p.CanOverride("width"))
+	params := url.Values{"width": {"900"}}
+	assert.Equal(t, params, p.Apply(params))
+}
+
+func TestApply(t *testing.T) {
+	p := &profile.Profile{Width: 1200, Format: "png", Dark: true, Overrides: []string{"format"}}
+	params := url.Values{"width": {"900"}, "format": {"jpeg"}, "title": {"hello"}}
+	applied := p.Apply(params)
+	// width not overridable, so profile default is used
+	assert.Equal(t, "1200", applied.Get("width"))
+	assert.Equal(t, "jpeg", applied.Get("format"))
+	assert.Equal(t, "true", applied.Get("dark"))
+	// template params are passed through
+	assert.Equal(t, "hello", applied.Get("title"))
+	// original params are not modified
+	assert.Equal(t, "900", params.Get("width"))
+}
+
+func TestAllowsTemplate(t *testing.T) {
+	p := &profile.Profile{Templates: []string{"blog"}}
+	assert.True(t, p.AllowsTemplate("blog"))
+	assert.False(t, p.AllowsTemplate("docs"))
+}
@@ -0,0 +1,45 @@
+package screenshot
+
+import (
+	"bytes"
+	"image/jpeg"
+	"image/png"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/card"
+	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/henrygd/social-image-server/internal/templates"
+)
+
+// renders a card.json template without the browser
+func renderCard(path string, req *global.ReqData) (buf []byte, imageExtension string, err error) {
+	start := time.Now()
+	c, err := card.Load(path)
+	if err != nil {
+		return nil, "", err
+	}
+	params := req.Profile.Apply(req.Params)
+	opts := card.Options{Dir: filepath.Dir(path), Width: int(global.ImageOptions.Width)}
+	// remote images are only fetched through the image proxy
+	if templates.ImageProxyEnabled() {
+		opts.FetchImage = templates.ProxiedImage
+	}
+	img, err := c.Render(params, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	imageFormat, imageExtension := getImageFormat(&params)
+	var out bytes.Buffer
+	if imageFormat == "png" {
+		err = png.Encode(&out, img)
+	} else {
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: int(getQuality(req.Profile))})
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	slog.Debug("Rendered card", "template", req.Template, "duration", time.Since(start))
+	return out.Bytes(), imageExtension, nil
+}
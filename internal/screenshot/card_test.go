@@ -0,0 +1,32 @@
+package screenshot
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/henrygd/social-image-server/internal/card"
+	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/henrygd/social-image-server/internal/templates"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderCardRemoteImages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), card.File)
+	os.WriteFile(path, []byte(`{"layers": [{"type": "rect", "color": "#0f172a"}, {"type": "image", "src": "{{img}}"}]}`), 0644)
+	options := global.ImageOptions
+	defer func() { global.ImageOptions = options }()
+	global.ImageOptions.Width = 600
+	global.ImageOptions.Quality = 80
+
+	// remote images aren't fetched unless the image proxy is enabled
+	templates.SetImageProxy(false, nil, 0)
+	_, _, err := renderCard(path, &global.ReqData{Params: url.Values{"img": {"https://example.com/a.png"}}})
+	assert.ErrorContains(t, err, "remote image https://example.com/a.png not allowed")
+
+	buf, ext, err := renderCard(path, &global.ReqData{Params: url.Values{}})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, buf)
+	assert.NotEmpty(t, ext)
+}
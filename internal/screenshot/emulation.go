@@ -0,0 +1,110 @@
+package screenshot
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+// matches language tags like "en", "en-US", "zh-Hant-TW" or "es-419"
+var localeRegex = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z][a-z]{3})?(-([A-Z]{2}|[0-9]{3}))?$`)
+
+// allowed device_scale values (device pixel ratios of common screens)
+var allowedDeviceScales = map[string]float64{
+	"1":   1,
+	"1.5": 1.5,
+	"2":   2,
+	"2.5": 2.5,
+	"3":   3,
+}
+
+// browser emulation settings for a screenshot
+type emulationOptions struct {
+	Dark          bool    `json:"dark"`
+	ReducedMotion bool    `json:"reduced_motion"`
+	Mobile        bool    `json:"mobile"`
+	Locale        string  `json:"locale,omitempty"`
+	Timezone      string  `json:"timezone,omitempty"`
+	DeviceScale   float64 `json:"device_scale,omitempty"`
+}
+
+// parses emulation settings from url params. invalid values are ignored.
+func getEmulationOptions(params *url.Values) (opts emulationOptions) {
+	opts.Dark = params.Get("dark") == "true"
+	opts.ReducedMotion = params.Get("reduced_motion") == "true"
+	opts.Mobile = params.Get("mobile") == "true"
+
+	if locale := params.Get("locale"); locale != "" {
+		if localeRegex.MatchString(locale) {
+			opts.Locale = locale
+		} else {
+			slog.Debug("Ignoring invalid locale", "value", locale)
+		}
+	}
+
+	if timezone := params.Get("timezone"); timezone != "" {
+		// reject "Local" which would leak the server's timezone
+		if _, err := time.LoadLocation(timezone); err == nil && timezone != "Local" {
+			opts.Timezone = timezone
+		} else {
+			slog.Debug("Ignoring invalid timezone", "value", timezone)
+		}
+	}
+
+	if deviceScale := params.Get("device_scale"); deviceScale != "" {
+		if scale, ok := allowedDeviceScales[deviceScale]; ok {
+			opts.DeviceScale = scale
+		} else {
+			slog.Debug("Ignoring invalid device_scale", "value", deviceScale)
+		}
+	}
+
+	return opts
+}
+
+// returns the chromedp actions needed to apply the emulation options.
+// viewport is set here as well because device metrics share the same override.
+func (opts emulationOptions) tasks(viewportWidth, viewportHeight int64, scale float64) chromedp.Tasks {
+	tasks := chromedp.Tasks{}
+
+	// set media features (prefers-color-scheme, prefers-reduced-motion)
+	var features []*emulation.MediaFeature
+	if opts.Dark {
+		features = append(features, &emulation.MediaFeature{Name: "prefers-color-scheme", Value: "dark"})
+	}
+	if opts.ReducedMotion {
+		features = append(features, &emulation.MediaFeature{Name: "prefers-reduced-motion", Value: "reduce"})
+	}
+	if len(features) > 0 {
+		tasks = append(tasks, chromedp.ActionFunc(func(ctx context.Context) error {
+			return emulation.SetEmulatedMedia().WithFeatures(features).Do(ctx)
+		}))
+	}
+
+	// set locale for Intl APIs and the Accept-Language header
+	if opts.Locale != "" {
+		tasks = append(tasks,
+			emulation.SetLocaleOverride().WithLocale(opts.Locale),
+			network.SetExtraHTTPHeaders(network.Headers{"Accept-Language": opts.Locale}),
+		)
+	}
+
+	if opts.Timezone != "" {
+		tasks = append(tasks, emulation.SetTimezoneOverride(opts.Timezone))
+	}
+
+	// set device metrics
+	viewportOpts := []chromedp.EmulateViewportOption{chromedp.EmulateScale(scale)}
+	if opts.Mobile {
+		viewportOpts = append(viewportOpts, chromedp.EmulateMobile)
+	}
+	tasks = append(tasks, chromedp.EmulateViewport(viewportWidth, viewportHeight, viewportOpts...))
+
+	return tasks
+}
@@ -0,0 +1,62 @@
+package screenshot
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetEmulationOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected emulationOptions
+	}{
+		{
+			name:     "Empty",
+			query:    "",
+			expected: emulationOptions{},
+		},
+		{
+			name:     "All valid",
+			query:    "dark=true&reduced_motion=true&mobile=true&locale=de-DE&timezone=Europe/Berlin&device_scale=2",
+			expected: emulationOptions{Dark: true, ReducedMotion: true, Mobile: true, Locale: "de-DE", Timezone: "Europe/Berlin", DeviceScale: 2},
+		},
+		{
+			name:     "Locale with script and region",
+			query:    "locale=zh-Hant-TW",
+			expected: emulationOptions{Locale: "zh-Hant-TW"},
+		},
+		{
+			name:     "Invalid values ignored",
+			query:    "dark=1&mobile=yes&locale=en_US;drop&timezone=Mars/Olympus&device_scale=10",
+			expected: emulationOptions{},
+		},
+		{
+			name:     "Local timezone ignored",
+			query:    "timezone=Local",
+			expected: emulationOptions{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params, _ := url.ParseQuery(test.query)
+			assert.Equal(t, test.expected, getEmulationOptions(&params))
+		})
+	}
+}
+
+func TestGetViewportDimensionsDeviceScale(t *testing.T) {
+	params := url.Values{"width": {"1800"}}
+	width, height, scale := getViewportDimensions(&params, 0)
+	assert.Equal(t, int64(1800), width)
+	assert.Equal(t, int64(945), height)
+	assert.InDelta(t, 2000.0/1800.0, scale, 0.0001)
+
+	// device scale overrides width
+	width, _, scale = getViewportDimensions(&params, 2)
+	assert.Equal(t, int64(1000), width)
+	assert.Equal(t, 2.0, scale)
+}
@@ -0,0 +1,70 @@
+package screenshot
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+	"github.com/henrygd/social-image-server/internal/templates"
+)
+
+// data exposed to templates as window.__OG_PARAMS__
+type pageParams struct {
+	Params   map[string]any `json:"params"`
+	Template templateInfo   `json:"template"`
+	Render   renderOptions  `json:"render"`
+}
+
+type templateInfo struct {
+	Name     string              `json:"name"`
+	Viewport *templates.Viewport `json:"viewport,omitempty"`
+	Format   string              `json:"format,omitempty"`
+}
+
+// settings the screenshot is taken with
+type renderOptions struct {
+	emulationOptions
+	Width   int64   `json:"width"`
+	Height  int64   `json:"height"`
+	Scale   float64 `json:"scale"`
+	Format  string  `json:"format"`
+	Quality int64   `json:"quality"`
+	Delay   int64   `json:"delay"`
+}
+
+// returns a script that sets window.__OG_PARAMS__ and dispatches an og:params
+// event on window once the document has loaded
+func paramsScript(templateName string, manifest *templates.Manifest, params url.Values, render renderOptions) (string, error) {
+	data := pageParams{
+		Params:   manifest.TypedParams(params),
+		Template: templateInfo{Name: templateName},
+		Render:   render,
+	}
+	if manifest != nil {
+		data.Template.Format = manifest.Format
+		if manifest.Viewport.Width != 0 {
+			data.Template.Viewport = &manifest.Viewport
+		}
+	}
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	return `(() => {
+		const params = Object.freeze(` + string(dataJSON) + `)
+		Object.defineProperty(window, '__OG_PARAMS__', { value: params })
+		document.addEventListener('DOMContentLoaded', () => {
+			window.dispatchEvent(new CustomEvent('og:params', { detail: params }))
+		})
+	})()`, nil
+}
+
+// adds a script that runs before any page scripts
+func addScriptToNewDocument(script string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		_, err := page.AddScriptToEvaluateOnNewDocument(script).Do(ctx)
+		return err
+	})
+}
@@ -0,0 +1,34 @@
+package screenshot
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/henrygd/social-image-server/internal/templates"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParamsScript(t *testing.T) {
+	manifest := &templates.Manifest{
+		Params: map[string]templates.Param{
+			"count": {Type: "number"},
+			"dark":  {Type: "boolean"},
+		},
+		Viewport: templates.Viewport{Width: 1200, Height: 630},
+		Format:   "png",
+	}
+	params := url.Values{"title": {"Hello"}, "count": {"3"}, "dark": {"true"}, "tag": {"a", "b"}, "_regen_": {"secret"}}
+	render := renderOptions{emulationOptions: emulationOptions{Dark: true}, Width: 1200, Height: 630, Scale: 1.5, Format: "png", Quality: 92}
+
+	script, err := paramsScript("blog", manifest, params, render)
+	assert.NoError(t, err)
+	assert.Contains(t, script, `{"params":{"count":3,"dark":true,"tag":["a","b"],"title":"Hello"},`+
+		`"template":{"name":"blog","viewport":{"width":1200,"height":630},"format":"png"},`+
+		`"render":{"dark":true,"reduced_motion":false,"mobile":false,"width":1200,"height":630,"scale":1.5,"format":"png","quality":92,"delay":0}}`)
+	assert.NotContains(t, script, "secret")
+	assert.Contains(t, script, "new CustomEvent('og:params'")
+
+	// without a manifest all params are strings
+	script, _ = paramsScript("plain", nil, url.Values{"count": {"3"}}, renderOptions{})
+	assert.Contains(t, script, `"params":{"count":"3"},"template":{"name":"plain"}`)
+}
@@ -2,26 +2,32 @@ package screenshot
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"log/slog"
-	"net/http"
 	"net/url"
-	"os"
 	"strconv"
-	"strings"
 	"time"
 
-	"github.com/chromedp/cdproto/emulation"
 	"github.com/chromedp/cdproto/page"
 	"github.com/chromedp/chromedp"
 	"github.com/henrygd/social-image-server/internal/browsercontext"
 	"github.com/henrygd/social-image-server/internal/database"
 	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/henrygd/social-image-server/internal/profile"
+	"github.com/henrygd/social-image-server/internal/storage"
 	"github.com/henrygd/social-image-server/internal/templates"
 )
 
-func getViewportDimensions(params *url.Values) (viewportWidth int64, viewportHeight int64, scale float64) {
+func getViewportDimensions(params *url.Values, deviceScale float64) (viewportWidth int64, viewportHeight int64, scale float64) {
 	paramWidth := params.Get("width")
-	if paramWidth != "" {
+	if deviceScale != 0 {
+		// device scale takes precedence over width so output stays IMG_WIDTH wide
+		viewportWidth = int64(global.ImageOptions.Width / deviceScale)
+	} else if paramWidth != "" {
 		viewportWidth, _ = strconv.ParseInt(paramWidth, 10, 64)
 	}
 	if viewportWidth == 0 {
@@ -60,12 +66,29 @@ func getImageFormat(params *url.Values) (imageFormat string, imageExtension stri
 	return global.ImageOptions.Format, global.ImageOptions.Extension
 }
 
+// returns the image quality from the profile or the global default
+func getQuality(p *profile.Profile) int64 {
+	if p != nil && p.Quality != 0 {
+		return p.Quality
+	}
+	return global.ImageOptions.Quality
+}
+
 // takeScreenshot takes a screenshot of a webpage.
 //
-// It accepts the validated URL as a string and parameters for the screenshot.
-// Returns the filepath of the saved screenshot and any error encountered.
-func takeScreenshot(validatedUrl string, params *url.Values) (filepath string, err error) {
-	viewportWidth, viewportHeight, scale := getViewportDimensions(params)
+// It accepts the URL to capture and the request data for the screenshot.
+// Returns the image data, its file extension, and any error encountered.
+func takeScreenshot(pageUrl string, req *global.ReqData, manifest *templates.Manifest) (buf []byte, imageExtension string, err error) {
+	// apply domain profile defaults and restrictions to params
+	appliedParams := req.Profile.Apply(req.Params)
+	params := &appliedParams
+	emulationOpts := getEmulationOptions(params)
+	viewportWidth, viewportHeight, scale := getViewportDimensions(params, emulationOpts.DeviceScale)
+	// template viewport replaces the width param
+	if manifest != nil && manifest.Viewport.Width != 0 {
+		viewportWidth, viewportHeight = manifest.Viewport.Width, manifest.Viewport.Height
+		scale = global.ImageOptions.Width / float64(viewportWidth)
+	}
 	delay := getDelay(params)
 	imageFormat, imageExtension := getImageFormat(params)
 
@@ -74,31 +97,46 @@ func takeScreenshot(validatedUrl string, params *url.Values) (filepath string, e
 	defer cancel()
 	defer browsercontext.TaskCleanup()
 
-	// create file for screenshot
-	f, err := os.CreateTemp(global.ImageDir, "*"+imageExtension)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
-	filepath = f.Name()
-
-	tasks := chromedp.Tasks{}
-
-	// set prefers dark mode
-	if params.Get("dark") == "true" {
-		tasks = append(tasks, chromedp.ActionFunc(func(ctx context.Context) error {
-			emulatedMedia := emulation.SetEmulatedMedia()
-			emulatedMedia.Features = append(emulatedMedia.Features, &emulation.MediaFeature{Name: "prefers-color-scheme", Value: "dark"})
-			return emulatedMedia.Do(ctx)
-		}))
-	}
+	// set emulation options (dark mode, locale, timezone, device metrics)
+	tasks := emulationOpts.tasks(viewportWidth, viewportHeight, scale)
 
 	// navigate to url
-	tasks = append(tasks,
-		// chromedp.Emulate(device.IPad),
-		chromedp.EmulateViewport(viewportWidth, viewportHeight, chromedp.EmulateScale(scale)),
-		chromedp.Navigate(validatedUrl),
-	)
+	var wait templates.Wait
+	if manifest != nil {
+		wait = manifest.Wait
+	}
+	lifecycleEvents := make(chan *page.EventLifecycleEvent, 32)
+	if wait.NetworkIdle {
+		tasks = append(tasks, listenLifecycleEvents(lifecycleEvents))
+	}
+	// expose params and render settings to the template
+	if req.Template != "" {
+		script, err := paramsScript(req.Template, manifest, *params, renderOptions{
+			emulationOptions: emulationOpts,
+			Width:            viewportWidth,
+			Height:           viewportHeight,
+			Scale:            scale,
+			Format:           imageFormat,
+			Quality:          getQuality(req.Profile),
+			Delay:            delay,
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		tasks = append(tasks, addScriptToNewDocument(script))
+	}
+	tasks = append(tasks, navigate(pageUrl))
+	// wait for the template to be ready
+	if wait.NetworkIdle {
+		tasks = append(tasks, waitNetworkIdle(lifecycleEvents, wait.Duration()))
+	}
+	if wait.Selector != "" {
+		tasks = append(tasks, waitVisible(wait.Selector, wait.Duration()))
+	}
+	// inject profile css
+	if req.Profile != nil && req.Profile.CSS != "" {
+		tasks = append(tasks, injectCSS(req.Profile.CSS))
+	}
 	// add delay
 	if delay != 0 {
 		tasks = append(tasks, chromedp.Sleep(time.Duration(delay)*time.Millisecond))
@@ -106,58 +144,188 @@ func takeScreenshot(validatedUrl string, params *url.Values) (filepath string, e
 	// take screenshot
 	tasks = append(tasks, chromedp.ActionFunc(func(ctx context.Context) error {
 		format := page.CaptureScreenshotFormat(imageFormat)
-		buf, err := page.CaptureScreenshot().WithFormat(format).WithQuality(global.ImageOptions.Quality).Do(ctx)
-		if err != nil {
-			return err
-		}
-		return os.WriteFile(filepath, buf, 0644)
+		buf, err = page.CaptureScreenshot().WithFormat(format).WithQuality(getQuality(req.Profile)).Do(ctx)
+		return err
 	}))
 
 	if err = chromedp.Run(taskCtx, tasks); err != nil {
-		// clean up empty file if tasks failed
-		os.Remove(filepath)
-		return "", err
+		return nil, "", err
 	}
 
-	return filepath, nil
+	return buf, imageExtension, nil
+}
+
+// navigates to the url. Fails if the page responds with an error status, so
+// error pages aren't saved as the image.
+func navigate(pageUrl string) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		res, err := chromedp.RunResponse(ctx, chromedp.Navigate(pageUrl))
+		if err != nil {
+			return err
+		}
+		if res != nil && (res.Status < 200 || res.Status > 299) {
+			return fmt.Errorf("page responded with status %d", res.Status)
+		}
+		return nil
+	})
+}
+
+// sends page lifecycle events to the channel, dropping them if it's full
+func listenLifecycleEvents(events chan<- *page.EventLifecycleEvent) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		chromedp.ListenTarget(ctx, func(ev interface{}) {
+			if e, ok := ev.(*page.EventLifecycleEvent); ok {
+				select {
+				case events <- e:
+				default:
+				}
+			}
+		})
+		return page.SetLifecycleEventsEnabled(true).Do(ctx)
+	})
+}
+
+// waits until the page has had no network connections for 500ms.
+// the screenshot is taken anyway if the timeout is reached.
+func waitNetworkIdle(events <-chan *page.EventLifecycleEvent, timeout time.Duration) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		frameTree, err := page.GetFrameTree().Do(ctx)
+		if err != nil {
+			return err
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			select {
+			case e := <-events:
+				// ignore events from before navigating
+				if e.Name == "networkIdle" && e.LoaderID == frameTree.Frame.LoaderID {
+					return nil
+				}
+			case <-timer.C:
+				slog.Debug("Timed out waiting for network idle")
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+}
+
+// waits until an element matching the selector is visible.
+// the screenshot is taken anyway if the timeout is reached.
+func waitVisible(selector string, timeout time.Duration) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		waitCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		err := chromedp.WaitVisible(selector, chromedp.ByQuery).Do(waitCtx)
+		if err != nil && ctx.Err() == nil {
+			slog.Debug("Timed out waiting for selector", "selector", selector)
+			return nil
+		}
+		return err
+	})
+}
+
+// appends a style element with the supplied css to the page
+func injectCSS(css string) chromedp.Action {
+	cssJSON, _ := json.Marshal(css)
+	// svg documents have no head, so the style goes in the root svg element
+	script := `(() => {
+		const style = document.head ? document.createElement('style') : document.createElementNS('http://www.w3.org/2000/svg', 'style')
+		style.textContent = ` + string(cssJSON) + `
+		;(document.head || document.documentElement).appendChild(style)
+	})()`
+	return chromedp.Evaluate(script, nil)
 }
 
-// Generates a screenshot of a URL.
-func Take(req *global.ReqData) (filepath string, err error) {
+// returns a random file name with the given extension
+func newFileName(extension string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b) + extension
+}
+
+// Generates a screenshot of a URL or template without saving it.
+// Returns the image data and its file extension.
+func Render(req *global.ReqData) (buf []byte, imageExtension string, err error) {
 	if req.Template == "" {
 		slog.Debug("Taking screenshot", "url", req.ValidatedURL)
 		req.ValidatedURL += "?og-image-request=true"
-		filepath, err = takeScreenshot(req.ValidatedURL, &req.Params)
+		return takeScreenshot(req.ValidatedURL, req, nil)
 	}
 
-	// if requesting template, start temp server for the screenshot
-	if req.Template != "" {
-		slog.Debug("Taking screenshot", "template", req.Template)
-		var server *http.Server
-		var serverURL string
-		server, serverURL, err = templates.TempServer(req.Template)
+	// card templates are drawn without the browser
+	if cardPath, ok := templates.CardPath(req.Template); ok {
+		return renderCard(cardPath, req)
+	}
+
+	// other templates are loaded from the template server
+	slog.Debug("Taking screenshot", "template", req.Template)
+	templateURL, err := templates.URL(req.Template)
+	if err != nil {
+		return nil, "", err
+	}
+	manifest, err := templates.LoadManifest(req.Template)
+	if err != nil {
+		return nil, "", err
+	}
+	// svg templates are captured at the size of their viewBox. the file is
+	// checked again here, since it may have been edited since it was uploaded.
+	if svgPath, ok := templates.SVGPath(req.Template); ok {
+		manifest, err = svgManifest(svgPath, manifest)
 		if err != nil {
-			return "", err
+			return nil, "", err
 		}
-		defer server.Close()
-		defer slog.Debug("Template server stopped", "template", req.Template)
-		serverURL += "?" + req.Params.Encode()
-		filepath, err = takeScreenshot(serverURL, &req.Params)
 	}
+	// remote images are loaded through the image proxy if enabled
+	proxied := *req
+	proxied.Params = templates.ProxyImages(manifest, req.Params)
+	// server-rendered templates that fail for these params fail the render
+	if err = templates.CheckIndex(req.Template, proxied.Params); err != nil {
+		return nil, "", err
+	}
+	templateURL += "?" + proxied.Params.Encode()
+	return takeScreenshot(templateURL, &proxied, manifest)
+}
 
+// Generates a screenshot of a URL and saves it to storage.
+// Returns the image added to the database.
+func Take(req *global.ReqData) (image *database.Image, err error) {
+	buf, imageExtension, err := Render(req)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	return Save(req, buf, imageExtension)
+}
+
+// Saves a rendered image to storage and the database, replacing the
+// previous image for the url. Returns the image added to the database.
+func Save(req *global.ReqData, buf []byte, imageExtension string) (image *database.Image, err error) {
+	file := newFileName(imageExtension)
+	if err = storage.Save(file, buf); err != nil {
+		return nil, err
 	}
 
-	// add image to database
-	err = database.AddImage(&database.Image{
+	hash := sha256.Sum256(buf)
+	image = &database.Image{
 		Url:      req.UrlKey,
-		File:     strings.TrimPrefix(filepath, global.ImageDir),
+		File:     file,
 		CacheKey: req.CacheKey,
-	})
+		FileSize: int64(len(buf)),
+		Hash:     hex.EncodeToString(hash[:]),
+	}
+	// profiles with their own cache time expire independently of CACHE_TIME
+	if req.Profile != nil && req.Profile.CacheTime != 0 {
+		image.Expires = database.ExpiresIn(time.Duration(req.Profile.CacheTime))
+	}
+
+	// add image to database
+	err = database.AddImage(image)
 	if err != nil {
-		return "", err
+		storage.Remove(file)
+		return nil, err
 	}
 
-	return filepath, nil
+	return image, nil
 }
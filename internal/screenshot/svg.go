@@ -0,0 +1,18 @@
+package screenshot
+
+import "github.com/henrygd/social-image-server/internal/templates"
+
+// returns a copy of the manifest with the viewport set to the size of the
+// svg, so it fills the page exactly
+func svgManifest(path string, manifest *templates.Manifest) (*templates.Manifest, error) {
+	size, err := templates.SVGSize(path)
+	if err != nil {
+		return nil, err
+	}
+	var svg templates.Manifest
+	if manifest != nil {
+		svg = *manifest
+	}
+	svg.Viewport = size
+	return &svg, nil
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Stores images in a local directory
+type FS struct {
+	dir string
+}
+
+func NewFS(dir string) *FS {
+	return &FS{dir: dir}
+}
+
+func (s *FS) path(name string) string {
+	return filepath.Join(s.dir, filepath.Base(name))
+}
+
+// Writes to a temp file and renames it so readers never see a partial image
+func (s *FS) Save(name string, data []byte) error {
+	f, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path(name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *FS) Open(name string) (File, Info, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, Info{}, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, Info{}, err
+	}
+	return f, Info{Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (s *FS) Stat(name string) (Info, error) {
+	stat, err := os.Stat(s.path(name))
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (s *FS) Remove(name string) error {
+	return os.Remove(s.path(name))
+}
+
+func (s *FS) List() ([]Entry, error) {
+	dirEntries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.Type().IsRegular() {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			// removed since reading the directory
+			continue
+		}
+		entries = append(entries, Entry{Name: dirEntry.Name(), Info: Info{Size: info.Size(), ModTime: info.ModTime()}})
+	}
+	return entries, nil
+}
@@ -0,0 +1,350 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hash of an empty payload, used for requests without a body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type S3Options struct {
+	// Base url of the S3 api, e.g. https://s3.us-east-1.amazonaws.com
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prepended to image names, e.g. "og/"
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// Use endpoint/bucket/key urls instead of bucket.endpoint/key
+	PathStyle bool
+}
+
+// Stores images in an S3-compatible bucket
+type S3 struct {
+	opts   S3Options
+	client *http.Client
+	// used to set request times in tests
+	now func() time.Time
+}
+
+func NewS3(opts S3Options) *S3 {
+	opts.Endpoint = strings.TrimSuffix(opts.Endpoint, "/")
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	return &S3{
+		opts:   opts,
+		client: &http.Client{Timeout: 30 * time.Second},
+		now:    time.Now,
+	}
+}
+
+// returns the url of the bucket, ending with a slash
+func (s *S3) bucketURL() (*url.URL, error) {
+	u, err := url.Parse(s.opts.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if s.opts.PathStyle {
+		u.Path += "/" + s.opts.Bucket + "/"
+	} else {
+		u.Host = s.opts.Bucket + "." + u.Host
+		u.Path += "/"
+	}
+	return u, nil
+}
+
+// returns the url of the object
+func (s *S3) objectURL(name string) (*url.URL, error) {
+	u, err := s.bucketURL()
+	if err != nil {
+		return nil, err
+	}
+	u.Path += s.opts.Prefix + name
+	return u, nil
+}
+
+// sends a signed request for the object
+func (s *S3) do(method, name string, body []byte, header http.Header) (*http.Response, error) {
+	u, err := s.objectURL(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.doURL(method, u, body, header)
+}
+
+// sends a signed request to the url
+func (s *S3) doURL(method string, u *url.URL, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	} else {
+		req.Body = http.NoBody
+	}
+	s.sign(req, payloadHash, s.now())
+	return s.client.Do(req)
+}
+
+func (s *S3) Save(name string, data []byte) error {
+	header := http.Header{}
+	header.Set("Content-Type", contentType(name))
+	resp, err := s.do(http.MethodPut, name, data, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// Downloads the image into memory so it can be served with range support
+func (s *S3) Open(name string) (File, Info, error) {
+	resp, err := s.do(http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, Info{}, err
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	info := responseInfo(resp)
+	info.Size = int64(len(data))
+	return nopCloser{bytes.NewReader(data)}, info, nil
+}
+
+func (s *S3) Stat(name string) (Info, error) {
+	resp, err := s.do(http.MethodHead, name, nil, nil)
+	if err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return Info{}, err
+	}
+	return responseInfo(resp), nil
+}
+
+// Buckets can be shared by several servers, each with its own database
+func (s *S3) Shared() bool {
+	return true
+}
+
+// S3 doesn't report missing objects on delete, so Stat is checked first
+func (s *S3) Remove(name string) error {
+	if _, err := s.Stat(name); err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodDelete, name, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// response of ListObjectsV2
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// Lists objects under the prefix, following pagination
+func (s *S3) List() ([]Entry, error) {
+	var entries []Entry
+	token := ""
+	for {
+		u, err := s.bucketURL()
+		if err != nil {
+			return nil, err
+		}
+		query := url.Values{"list-type": {"2"}, "prefix": {s.opts.Prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u.RawQuery = canonicalQuery(query)
+		resp, err := s.doURL(http.MethodGet, u, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listResult
+		if err = checkResponse(resp); err == nil {
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, s.opts.Prefix)
+			// skip objects in nested "directories"
+			if name == "" || strings.Contains(name, "/") {
+				continue
+			}
+			entries = append(entries, Entry{Name: name, Info: Info{Size: object.Size, ModTime: object.LastModified}})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return entries, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Returns a presigned GET url for the image valid for expiry
+func (s *S3) PresignGet(name string, expiry time.Duration) (string, error) {
+	u, err := s.objectURL(name)
+	if err != nil {
+		return "", err
+	}
+	t := s.now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	scope := s.scope(t)
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.opts.AccessKey+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expiry.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = canonicalQuery(query)
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	u.RawQuery += "&X-Amz-Signature=" + s.signature(t, amzDate, scope, canonicalRequest)
+	return u.String(), nil
+}
+
+// adds AWS signature version 4 headers to the request
+func (s *S3) sign(req *http.Request, payloadHash string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// host and x-amz-* headers are signed, along with content-type if set
+	headers := map[string]string{"host": req.URL.Host}
+	for key := range req.Header {
+		lower := strings.ToLower(key)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(req.Header.Get(key))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := s.scope(t)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.opts.AccessKey, scope, signedHeaders, s.signature(t, amzDate, scope, canonicalRequest),
+	))
+}
+
+func (s *S3) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.opts.Region + "/s3/aws4_request"
+}
+
+// signs the canonical request with a key derived from the secret key
+func (s *S3) signature(t time.Time, amzDate, scope, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := hmacSHA256([]byte("AWS4"+s.opts.SecretKey), t.Format("20060102"))
+	key = hmacSHA256(key, s.opts.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// returns query params sorted by key with spaces encoded as %20
+func canonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+func checkResponse(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return fs.ErrNotExist
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("s3: %s %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func responseInfo(resp *http.Response) Info {
+	info := Info{Size: resp.ContentLength}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	return info
+}
+
+func contentType(name string) string {
+	if strings.HasSuffix(name, ".png") {
+		return "image/png"
+	}
+	return "image/jpeg"
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error { return nil }
+
+var _ Presigner = (*S3)(nil)
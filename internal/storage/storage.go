@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/config"
+	"github.com/henrygd/social-image-server/internal/global"
+)
+
+// Information about a stored image
+type Info struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Stored image returned by List
+type Entry struct {
+	Name string
+	Info
+}
+
+// Stored image opened for reading
+type File interface {
+	io.ReadSeekCloser
+}
+
+// Backend for storing image files. Names are relative to the storage root.
+// Methods return an error matching fs.ErrNotExist if the image doesn't exist.
+type Storage interface {
+	// Writes the image, replacing it if it exists
+	Save(name string, data []byte) error
+	// Opens the image for reading
+	Open(name string) (File, Info, error)
+	// Returns information about the image
+	Stat(name string) (Info, error)
+	// Deletes the image
+	Remove(name string) error
+	// Returns all stored files
+	List() ([]Entry, error)
+}
+
+// Storage that can create temporary public urls for images
+type Presigner interface {
+	PresignGet(name string, expiry time.Duration) (string, error)
+}
+
+// Storage that other servers may also save images to, so files that aren't
+// in this server's database aren't necessarily orphans
+type Shared interface {
+	Shared() bool
+}
+
+var backend Storage
+
+// Sets up the storage backend from config
+func Init(cfg *config.Config) {
+	switch cfg.Storage {
+	case "s3":
+		slog.Debug("Using S3 storage", "endpoint", cfg.S3Endpoint, "bucket", cfg.S3Bucket)
+		backend = NewS3(S3Options{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			Prefix:    cfg.S3Prefix,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			PathStyle: cfg.S3PathStyle,
+		})
+	default:
+		slog.Debug("Using filesystem storage", "dir", global.ImageDir)
+		backend = NewFS(global.ImageDir)
+	}
+}
+
+// Sets the storage backend
+func Set(s Storage) {
+	backend = s
+}
+
+// Returns the storage backend
+func Get() Storage {
+	return backend
+}
+
+// Writes the image to the storage backend
+func Save(name string, data []byte) error {
+	return backend.Save(cleanName(name), data)
+}
+
+// Opens the image from the storage backend
+func Open(name string) (File, Info, error) {
+	return backend.Open(cleanName(name))
+}
+
+// Returns information about the image from the storage backend
+func Stat(name string) (Info, error) {
+	return backend.Stat(cleanName(name))
+}
+
+// Deletes the image from the storage backend
+func Remove(name string) error {
+	return backend.Remove(cleanName(name))
+}
+
+// Returns all files in the storage backend
+func List() ([]Entry, error) {
+	return backend.List()
+}
+
+// Checks if other servers may save images to the storage backend
+func IsShared() bool {
+	s, ok := backend.(Shared)
+	return ok && s.Shared()
+}
+
+// removes the leading slash stored with images created before storage backends
+func cleanName(name string) string {
+	return strings.TrimPrefix(name, "/")
+}
@@ -0,0 +1,357 @@
+package templates
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/card"
+	"github.com/henrygd/social-image-server/internal/global"
+)
+
+// limits for uploaded template archives
+var (
+	MaxArchiveSize   int64 = 50 << 20
+	maxExtractedSize int64 = 200 << 20
+	maxFiles               = 2000
+)
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,63}$`)
+
+// Returned when an uploaded archive can't be installed
+var ErrInvalidArchive = errors.New("invalid template archive")
+
+// serializes changes to the template directory
+var installLock sync.Mutex
+
+// Information about an installed template
+type Info struct {
+	Name     string    `json:"name"`
+	Version  string    `json:"version"`
+	Modified time.Time `json:"modified"`
+	// previous versions that can be requested as name@version, newest first
+	PreviousVersions []string `json:"previous_versions"`
+	// nil if the template doesn't have a manifest or it's invalid
+	Manifest *Manifest `json:"manifest"`
+	// set if the manifest is invalid
+	ManifestError string `json:"manifest_error,omitempty"`
+}
+
+// Checks if a name can be used for an uploaded template
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// Returns information about a template
+func GetInfo(name string) (*Info, error) {
+	if strings.Contains(name, "@") || !IsValid(name) {
+		return nil, fs.ErrNotExist
+	}
+	// the link of an uploaded template changes when it's replaced
+	stat, err := os.Lstat(filepath.Join(global.TemplateDir, name))
+	if err != nil {
+		return nil, err
+	}
+	info := &Info{Name: name, Modified: stat.ModTime(), PreviousVersions: PreviousVersions(name)}
+	if info.Version, err = Version(name); err != nil {
+		return nil, err
+	}
+	if info.Manifest, err = LoadManifest(name); err != nil {
+		info.ManifestError = err.Error()
+	}
+	return info, nil
+}
+
+// Returns information about all templates
+func ListInfo() []*Info {
+	names := List()
+	infos := make([]*Info, 0, len(names))
+	for _, name := range names {
+		if info, err := GetInfo(name); err == nil {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+// Extracts a zip or tar (optionally gzipped) archive into a new template,
+// replacing the template if it exists. The archive is extracted to a staging
+// directory first and the template is switched to it by replacing a link, so
+// renders never see a partially written or missing template.
+// Files may be at the root of the archive or in a single top level directory.
+func Install(name string, archive io.ReaderAt, size int64) error {
+	if !ValidName(name) {
+		return fmt.Errorf("%w: invalid name %q", ErrInvalidArchive, name)
+	}
+	if size > MaxArchiveSize {
+		return fmt.Errorf("%w: archive larger than %d bytes", ErrInvalidArchive, MaxArchiveSize)
+	}
+	staging, err := os.MkdirTemp(global.TemplateDir, ".staging-"+name+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	files := filepath.Join(staging, "files")
+	if err := extractArchive(archive, size, files); err != nil {
+		return err
+	}
+	root, err := templateRoot(files)
+	if err != nil {
+		return err
+	}
+	if _, err := loadManifestFile(filepath.Join(root, ManifestFile)); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+	}
+	if _, _, err := parseIndex(name, root); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+	}
+	hasIndex := fileExists(filepath.Join(root, "index.html")) || fileExists(filepath.Join(root, IndexTemplate))
+	if !hasIndex && fileExists(filepath.Join(root, card.File)) {
+		if _, err := card.Load(filepath.Join(root, card.File)); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+		}
+	} else if !hasIndex && fileExists(filepath.Join(root, SVGFile)) {
+		if _, err := SVGSize(filepath.Join(root, SVGFile)); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+		}
+	} else if !hasIndex {
+		return fmt.Errorf("%w: missing index.html, %s, %s or %s", ErrInvalidArchive, IndexTemplate, card.File, SVGFile)
+	}
+
+	version, err := hashDir(root)
+	if err != nil {
+		return err
+	}
+
+	installLock.Lock()
+	defer installLock.Unlock()
+	// uploads are kept in the versions directory, and the template is a link
+	// to the current one
+	versions := filepath.Join(global.TemplateDir, versionsDir, name)
+	if err := os.MkdirAll(versions, 0755); err != nil {
+		return err
+	}
+	target := filepath.Join(versions, version)
+	// the same files may have been uploaded before
+	if err := os.Rename(root, target); err != nil && !isDir(target) {
+		return err
+	}
+	dest := filepath.Join(global.TemplateDir, name)
+	previous, hasPrevious := currentDir(name)
+	if hasPrevious && previous == dest {
+		// templates created by hand are moved into the versions directory on
+		// their first upload, which is the only time a render can miss them
+		if previous, err = keepHandmadeVersion(name, dest); err != nil {
+			return err
+		}
+	}
+	link := filepath.Join(staging, "link")
+	if err := os.Symlink(filepath.Join(versionsDir, name, version), link); err != nil {
+		return err
+	}
+	// renaming the new link over the old one swaps the template in one step
+	if err := os.Rename(link, dest); err != nil {
+		return err
+	}
+	forgetVersion(name)
+	if hasPrevious && previous != target {
+		retireVersion(name, previous)
+	}
+	return nil
+}
+
+// moves a template created by hand into the versions directory so it can be
+// replaced by a link. Returns its new directory.
+func keepHandmadeVersion(name, dir string) (string, error) {
+	version, err := hashDir(dir)
+	if err != nil {
+		return "", err
+	}
+	dest := filepath.Join(global.TemplateDir, versionsDir, name, version)
+	if isDir(dest) {
+		return dest, os.RemoveAll(dir)
+	}
+	return dest, os.Rename(dir, dest)
+}
+
+// Deletes a template
+func Remove(name string) error {
+	if strings.Contains(name, "@") || !IsValid(name) {
+		return fs.ErrNotExist
+	}
+	installLock.Lock()
+	defer installLock.Unlock()
+	// rename first so the template disappears at once
+	trash, err := os.MkdirTemp(global.TemplateDir, ".deleted-"+name+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(trash)
+	if err := os.Rename(filepath.Join(global.TemplateDir, name), filepath.Join(trash, name)); err != nil {
+		return err
+	}
+	forgetVersion(name)
+	return os.RemoveAll(filepath.Join(global.TemplateDir, versionsDir, name))
+}
+
+// extracts a zip, tar or tar.gz archive into dir
+func extractArchive(archive io.ReaderAt, size int64, dir string) error {
+	header := make([]byte, 4)
+	archive.ReadAt(header, 0)
+	x := &extractor{dir: dir}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		zr, err := zip.NewReader(archive, size)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+		}
+		for _, f := range zr.File {
+			if err := x.zipEntry(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(io.NewSectionReader(archive, 0, size))
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+		}
+		defer gz.Close()
+		return x.tar(bufio.NewReader(gz))
+	default:
+		return x.tar(io.NewSectionReader(archive, 0, size))
+	}
+}
+
+// writes archive entries into a directory, enforcing the size limits
+type extractor struct {
+	dir   string
+	files int
+	size  int64
+}
+
+func (x *extractor) tar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := x.dirEntry(header.Name); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := x.fileEntry(header.Name, tr); err != nil {
+				return err
+			}
+		case tar.TypeXGlobalHeader:
+		default:
+			// links could point outside the template
+			return fmt.Errorf("%w: unsupported entry type for %s", ErrInvalidArchive, header.Name)
+		}
+	}
+}
+
+func (x *extractor) zipEntry(f *zip.File) error {
+	// resource forks added by macOS
+	if strings.HasPrefix(f.Name, "__MACOSX/") {
+		return nil
+	}
+	if f.FileInfo().IsDir() {
+		return x.dirEntry(f.Name)
+	}
+	if !f.Mode().IsRegular() {
+		return fmt.Errorf("%w: unsupported entry type for %s", ErrInvalidArchive, f.Name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+	}
+	defer rc.Close()
+	return x.fileEntry(f.Name, rc)
+}
+
+// returns the destination of an entry, rejecting paths outside the directory
+func (x *extractor) path(name string) (string, error) {
+	local := filepath.FromSlash(strings.TrimSuffix(name, "/"))
+	if strings.Contains(name, `\`) || !filepath.IsLocal(local) {
+		return "", fmt.Errorf("%w: invalid path %q", ErrInvalidArchive, name)
+	}
+	return filepath.Join(x.dir, local), nil
+}
+
+func (x *extractor) dirEntry(name string) error {
+	dest, err := x.path(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(dest, 0755)
+}
+
+func (x *extractor) fileEntry(name string, r io.Reader) error {
+	dest, err := x.path(name)
+	if err != nil {
+		return err
+	}
+	if x.files++; x.files > maxFiles {
+		return fmt.Errorf("%w: more than %d files", ErrInvalidArchive, maxFiles)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	// duplicate entries are rejected
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+	}
+	n, err := io.Copy(f, io.LimitReader(r, maxExtractedSize-x.size+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if x.size += n; x.size > maxExtractedSize {
+		return fmt.Errorf("%w: extracted size larger than %d bytes", ErrInvalidArchive, maxExtractedSize)
+	}
+	return nil
+}
+
+// returns the directory containing the template files. Archives of a folder
+// have all files in a single top level directory.
+func templateRoot(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		return filepath.Join(dir, entries[0].Name()), nil
+	}
+	return dir, nil
+}
+
+func fileExists(path string) bool {
+	stat, err := os.Stat(path)
+	return err == nil && stat.Mode().IsRegular()
+}
@@ -0,0 +1,259 @@
+package templates
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/card"
+	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/stretchr/testify/assert"
+)
+
+type archiveFile struct {
+	name, body string
+	typeflag   byte
+}
+
+func zipArchive(t *testing.T, files ...archiveFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(f.body))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func tarGzArchive(t *testing.T, files ...archiveFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		header := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.body)), Typeflag: f.typeflag}
+		if f.typeflag == tar.TypeSymlink {
+			header.Linkname, header.Size = f.body, 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Size > 0 {
+			tw.Write([]byte(f.body))
+		}
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func install(name string, archive []byte) error {
+	return Install(name, bytes.NewReader(archive), int64(len(archive)))
+}
+
+func TestInstall(t *testing.T) {
+	global.TemplateDir = t.TempDir()
+
+	err := install("blog", zipArchive(t,
+		archiveFile{name: "index.html", body: "v1"},
+		archiveFile{name: "assets/app.js", body: "app"},
+		archiveFile{name: "template.json", body: `{"params": {"title": {"required": true}}}`},
+	))
+	assert.NoError(t, err)
+	data, _ := os.ReadFile(filepath.Join(global.TemplateDir, "blog", "assets", "app.js"))
+	assert.Equal(t, "app", string(data))
+	info, err := GetInfo("blog")
+	assert.NoError(t, err)
+	assert.True(t, info.Manifest.Params["title"].Required)
+	assert.Len(t, info.Version, VersionLength)
+	v1 := info.Version
+
+	// replaced by a gzipped tarball with files in a top level directory
+	err = install("blog", tarGzArchive(t,
+		archiveFile{name: "dist/", typeflag: tar.TypeDir},
+		archiveFile{name: "dist/index.html.tmpl", body: "v2", typeflag: tar.TypeReg},
+	))
+	assert.NoError(t, err)
+	data, _ = os.ReadFile(filepath.Join(global.TemplateDir, "blog", "index.html.tmpl"))
+	assert.Equal(t, "v2", string(data))
+	assert.NoFileExists(t, filepath.Join(global.TemplateDir, "blog", "assets", "app.js"))
+	assert.Equal(t, []string{"blog"}, List())
+
+	// previous version is still addressable
+	info, _ = GetInfo("blog")
+	assert.NotEqual(t, v1, info.Version)
+	assert.Equal(t, []string{v1}, info.PreviousVersions)
+	dir, ok := Dir("blog@" + v1)
+	assert.True(t, ok)
+	assert.FileExists(t, filepath.Join(dir, "assets", "app.js"))
+	version, _ := Version("blog@" + v1)
+	assert.Equal(t, v1, version)
+	_, ok = Dir("blog@" + info.Version)
+	assert.True(t, ok)
+	_, ok = Dir("blog@000000000000")
+	assert.False(t, ok)
+
+	// card templates don't need html
+	assert.NoError(t, install("card", zipArchive(t, archiveFile{name: "card.json", body: `{"layers": [{"type": "rect"}]}`})))
+	path, ok := CardPath("card")
+	assert.True(t, ok)
+	cardDir, _ := Dir("card")
+	assert.Equal(t, filepath.Join(cardDir, card.File), path)
+	_, ok = CardPath("blog")
+	assert.False(t, ok)
+	assert.NoError(t, Remove("card"))
+
+	// and neither do svg templates
+	assert.NoError(t, install("vector", zipArchive(t, archiveFile{name: "index.svg", body: `<svg viewBox="0 0 1200 630"/>`})))
+	_, ok = SVGPath("vector")
+	assert.True(t, ok)
+	assert.NoError(t, Remove("vector"))
+
+	assert.NoError(t, Remove("blog"))
+	assert.Empty(t, List())
+	assert.True(t, errors.Is(Remove("blog"), fs.ErrNotExist))
+	_, ok = Dir("blog@" + v1)
+	assert.False(t, ok)
+	// only the empty versions directory is left
+	entries, _ := os.ReadDir(global.TemplateDir)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, versionsDir, entries[0].Name())
+	}
+}
+
+func TestVersion(t *testing.T) {
+	global.TemplateDir = t.TempDir()
+	dir := filepath.Join(global.TemplateDir, "card")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("one"), 0644)
+
+	v1, err := Version("card")
+	assert.NoError(t, err)
+	again, _ := Version("card")
+	assert.Equal(t, v1, again)
+
+	// files are checked for changes periodically, not on every request
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("two"), 0644)
+	cached, _ := Version("card")
+	assert.Equal(t, v1, cached)
+
+	// editing files in place changes the version
+	Refresh()
+	v2, _ := Version("card")
+	assert.NotEqual(t, v1, v2)
+	defer func(interval time.Duration) { versionCheckInterval = interval }(versionCheckInterval)
+	versionCheckInterval = 0
+	os.WriteFile(filepath.Join(dir, "style.css"), []byte(""), 0644)
+	v3, _ := Version("card")
+	assert.NotEqual(t, v2, v3)
+
+	_, err = Version("missing")
+	assert.Error(t, err)
+}
+
+func TestInstallSwapsAtomically(t *testing.T) {
+	global.TemplateDir = t.TempDir()
+	// templates created by hand are replaced on their first upload
+	dir := filepath.Join(global.TemplateDir, "blog")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("by hand"), 0644)
+	handmade, _ := Version("blog")
+	assert.NoError(t, install("blog", zipArchive(t, archiveFile{name: "index.html", body: "0"})))
+	assert.Equal(t, []string{handmade}, PreviousVersions("blog"))
+	stat, _ := os.Lstat(dir)
+	assert.Equal(t, fs.ModeSymlink, stat.Mode()&fs.ModeSymlink)
+
+	// renders during an upload see the old or new template, never neither.
+	// versions aren't pruned here, so a slow check can't lose the version it
+	// just resolved.
+	defer func(keep int) { keepVersions = keep }(keepVersions)
+	keepVersions = 100
+	done := make(chan struct{})
+	missing := make(chan string, 1)
+	go func() {
+		defer close(missing)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if !IsValid("blog") {
+				missing <- "blog"
+				return
+			}
+		}
+	}()
+	for i := range 20 {
+		assert.NoError(t, install("blog", zipArchive(t, archiveFile{name: "index.html", body: strconv.Itoa(i)})))
+	}
+	close(done)
+	assert.Empty(t, <-missing)
+	data, _ := os.ReadFile(filepath.Join(dir, "index.html"))
+	assert.Equal(t, "19", string(data))
+
+	// links can't point at other templates
+	os.Symlink(filepath.Join(versionsDir, "blog", handmade), filepath.Join(global.TemplateDir, "other"))
+	assert.False(t, IsValid("other"))
+	assert.Equal(t, []string{"blog"}, List())
+}
+
+func TestKeepVersions(t *testing.T) {
+	global.TemplateDir = t.TempDir()
+	defer func(keep int) { keepVersions = keep }(keepVersions)
+	keepVersions = 2
+	for _, body := range []string{"1", "2", "3", "4"} {
+		assert.NoError(t, install("blog", zipArchive(t, archiveFile{name: "index.html", body: body})))
+	}
+	assert.Len(t, PreviousVersions("blog"), 2)
+}
+
+func TestInstallRejectsBadArchives(t *testing.T) {
+	global.TemplateDir = t.TempDir()
+	os.MkdirAll(filepath.Join(global.TemplateDir, "blog"), 0755)
+	os.WriteFile(filepath.Join(global.TemplateDir, "blog", "index.html"), []byte("original"), 0644)
+	index := archiveFile{name: "index.html", body: "new", typeflag: tar.TypeReg}
+
+	for name, archive := range map[string][]byte{
+		"path traversal":   zipArchive(t, index, archiveFile{name: "../evil.js", body: "x"}),
+		"absolute path":    tarGzArchive(t, index, archiveFile{name: "/etc/evil", body: "x", typeflag: tar.TypeReg}),
+		"symlink":          tarGzArchive(t, index, archiveFile{name: "passwd", body: "/etc/passwd", typeflag: tar.TypeSymlink}),
+		"duplicate entry":  zipArchive(t, index, index),
+		"missing index":    zipArchive(t, archiveFile{name: "app.js", body: "x"}),
+		"invalid manifest": zipArchive(t, index, archiveFile{name: "template.json", body: `{"format": "gif"}`}),
+		"invalid card":     zipArchive(t, archiveFile{name: "card.json", body: `{"layers": [{"type": "circle"}]}`}),
+		"invalid svg":      zipArchive(t, archiveFile{name: "index.svg", body: `<svg width="100%"/>`}),
+		"invalid template": zipArchive(t, archiveFile{name: "index.html.tmpl", body: "{{.Params.title"}),
+		"not an archive":   []byte("hello"),
+	} {
+		err := install("blog", archive)
+		assert.True(t, errors.Is(err, ErrInvalidArchive), name)
+	}
+	assert.True(t, errors.Is(install("../blog", zipArchive(t, index)), ErrInvalidArchive))
+
+	// size limits
+	defer func(size int64, files int) { maxExtractedSize, maxFiles = size, files }(maxExtractedSize, maxFiles)
+	maxExtractedSize, maxFiles = 10, 2
+	assert.ErrorContains(t, install("blog", zipArchive(t, archiveFile{name: "index.html", body: "more than ten bytes"})), "extracted size")
+	assert.ErrorContains(t, install("blog", zipArchive(t, index, archiveFile{name: "a"}, archiveFile{name: "b"})), "more than 2 files")
+
+	// original template is untouched
+	data, _ := os.ReadFile(filepath.Join(global.TemplateDir, "blog", "index.html"))
+	assert.Equal(t, "original", string(data))
+	entries, _ := os.ReadDir(global.TemplateDir)
+	assert.Len(t, entries, 1)
+	assert.NoFileExists(t, filepath.Join(filepath.Dir(global.TemplateDir), "evil.js"))
+}
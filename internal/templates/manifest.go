@@ -0,0 +1,278 @@
+package templates
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/henrygd/social-image-server/internal/profile"
+)
+
+// name of the optional manifest file in a template directory
+const ManifestFile = "template.json"
+
+// default and maximum time to wait for a template to be ready
+const (
+	defaultWaitTimeout = 5 * time.Second
+	maxWaitTimeout     = 10 * time.Second
+)
+
+// Returned when a template's manifest can't be read or is invalid
+var ErrInvalidManifest = errors.New("invalid " + ManifestFile)
+
+// params that are always passed to templates, even if not declared
+var reservedParams = append([]string{"url", "_regen_"}, profile.RenderParams...)
+
+// Declared template settings and parameters read from template.json
+type Manifest struct {
+	// all params are passed through if nil
+	Params   map[string]Param `json:"params"`
+	Viewport Viewport         `json:"viewport"`
+	// default image format (jpeg, png)
+	Format string `json:"format"`
+	Wait   Wait   `json:"wait"`
+}
+
+// Parameter accepted by a template
+type Param struct {
+	// string (default), number, boolean or image (an http url)
+	Type     string `json:"type"`
+	Required bool   `json:"required"`
+	// maximum length in characters. no limit if zero.
+	MaxLength int      `json:"max_length"`
+	Enum      []string `json:"enum"`
+	Default   string   `json:"default"`
+}
+
+// Size of the page in css pixels. Replaces the width param if set.
+type Viewport struct {
+	Width  int64 `json:"width"`
+	Height int64 `json:"height"`
+}
+
+// What to wait for after the page loads, before taking the screenshot
+type Wait struct {
+	// css selector of an element that must be visible
+	Selector string `json:"selector"`
+	// wait until there are no network connections for 500ms
+	NetworkIdle bool `json:"network_idle"`
+	// maximum wait in milliseconds (default 5000, max 10000)
+	Timeout int64 `json:"timeout"`
+}
+
+// Errors found when validating request params against a manifest
+type ParamsError struct {
+	Errors []string
+}
+
+func (e *ParamsError) Error() string {
+	msg := "Invalid template parameters:"
+	for _, err := range e.Errors {
+		msg += "\n- " + err
+	}
+	return msg
+}
+
+// Reads the manifest of a template. Returns nil without an error if the
+// template doesn't have one.
+func LoadManifest(templateName string) (*Manifest, error) {
+	dir, ok := Dir(templateName)
+	if !ok {
+		return nil, nil
+	}
+	return loadManifestFile(filepath.Join(dir, ManifestFile))
+}
+
+func loadManifestFile(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidManifest, err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidManifest, err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidManifest, err)
+	}
+	return &m, nil
+}
+
+// Checks manifest values and returns all errors found
+func (m *Manifest) Validate() error {
+	var errs []error
+	for _, name := range sortedKeys(m.Params) {
+		p := m.Params[name]
+		switch p.Type {
+		case "", "string", "number", "boolean", "image":
+		default:
+			errs = append(errs, fmt.Errorf("param %s: invalid type %q (string, number, boolean, image)", name, p.Type))
+			continue
+		}
+		if p.MaxLength < 0 {
+			errs = append(errs, fmt.Errorf("param %s: invalid max_length %d", name, p.MaxLength))
+		}
+		if p.Default != "" {
+			if err := p.check(p.Default); err != nil {
+				errs = append(errs, fmt.Errorf("param %s: invalid default: %w", name, err))
+			}
+		}
+	}
+	if m.Viewport != (Viewport{}) && (m.Viewport.Width < 200 || m.Viewport.Width > 2400 || m.Viewport.Height < 100 || m.Viewport.Height > 2400) {
+		errs = append(errs, fmt.Errorf("invalid viewport %dx%d (width 200-2400, height 100-2400)", m.Viewport.Width, m.Viewport.Height))
+	}
+	if m.Format != "" && m.Format != "jpeg" && m.Format != "png" {
+		errs = append(errs, fmt.Errorf("invalid format %q (jpeg, png)", m.Format))
+	}
+	if m.Wait.Timeout < 0 || time.Duration(m.Wait.Timeout)*time.Millisecond > maxWaitTimeout {
+		errs = append(errs, fmt.Errorf("invalid wait timeout %d (min 0, max 10000)", m.Wait.Timeout))
+	}
+	return errors.Join(errs...)
+}
+
+// Returns the time to wait for the wait selector or network idle
+func (w Wait) Duration() time.Duration {
+	if w.Timeout == 0 {
+		return defaultWaitTimeout
+	}
+	return time.Duration(w.Timeout) * time.Millisecond
+}
+
+// Validates params against the manifest. Returns a copy with undeclared
+// params removed and defaults applied, or a *ParamsError listing all problems.
+func (m *Manifest) Apply(params url.Values) (url.Values, error) {
+	applied := m.Filter(params)
+	var errs []string
+	for _, name := range sortedKeys(m.Params) {
+		p := m.Params[name]
+		value := applied.Get(name)
+		if value == "" && p.Default != "" {
+			value = p.Default
+			applied.Set(name, value)
+		}
+		if value == "" {
+			if p.Required {
+				errs = append(errs, fmt.Sprintf("%s is required", name))
+			}
+			continue
+		}
+		if err := p.check(value); err != nil {
+			errs = append(errs, fmt.Sprintf("%s %v", name, err))
+		}
+	}
+	if m.Format != "" && !applied.Has("format") {
+		applied.Set("format", m.Format)
+	}
+	if len(errs) > 0 {
+		return nil, &ParamsError{Errors: errs}
+	}
+	return applied, nil
+}
+
+// Returns a copy of params without undeclared params
+func (m *Manifest) Filter(params url.Values) url.Values {
+	if m.Params == nil {
+		return cloneParams(params)
+	}
+	filtered := make(url.Values, len(params))
+	for key, values := range params {
+		if _, ok := m.Params[key]; ok || slices.Contains(reservedParams, key) {
+			filtered[key] = values
+		}
+	}
+	return filtered
+}
+
+// Returns params converted to their declared types. Repeated params are
+// arrays. _regen_ is left out so the key isn't exposed to the page.
+func (m *Manifest) TypedParams(params url.Values) map[string]any {
+	typed := make(map[string]any, len(params))
+	for key, values := range params {
+		if key == "_regen_" || len(values) == 0 {
+			continue
+		}
+		var p Param
+		if m != nil {
+			p = m.Params[key]
+		}
+		converted := make([]any, len(values))
+		for i, value := range values {
+			converted[i] = p.convert(value)
+		}
+		if len(converted) == 1 {
+			typed[key] = converted[0]
+		} else {
+			typed[key] = converted
+		}
+	}
+	return typed
+}
+
+// converts a valid value to the param's type
+func (p Param) convert(value string) any {
+	switch p.Type {
+	case "number":
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			return n
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return value
+}
+
+// checks a value against the param's type, length and enum
+func (p Param) check(value string) error {
+	switch p.Type {
+	case "number":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return errors.New("must be a number")
+		}
+	case "boolean":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return errors.New("must be a boolean")
+		}
+	case "image":
+		if !isRemoteURL(value) {
+			return errors.New("must be an http or https url")
+		}
+	}
+	if p.MaxLength > 0 && utf8.RuneCountInString(value) > p.MaxLength {
+		return fmt.Errorf("must be at most %d characters", p.MaxLength)
+	}
+	if len(p.Enum) > 0 && !slices.Contains(p.Enum, value) {
+		return fmt.Errorf("must be one of %v", p.Enum)
+	}
+	return nil
+}
+
+func sortedKeys(params map[string]Param) []string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func cloneParams(params url.Values) url.Values {
+	cloned := make(url.Values, len(params))
+	for key, values := range params {
+		cloned[key] = values
+	}
+	return cloned
+}
@@ -0,0 +1,102 @@
+package templates
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeManifest(t *testing.T, name, manifest string) {
+	t.Helper()
+	dir := filepath.Join(global.TemplateDir, name)
+	os.MkdirAll(dir, 0755)
+	if err := os.WriteFile(filepath.Join(dir, ManifestFile), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadManifest(t *testing.T) {
+	global.TemplateDir = t.TempDir()
+	os.MkdirAll(filepath.Join(global.TemplateDir, "plain"), 0755)
+	m, err := LoadManifest("plain")
+	assert.NoError(t, err)
+	assert.Nil(t, m)
+
+	writeManifest(t, "blog", `{
+		"params": {"title": {"required": true, "max_length": 10}},
+		"viewport": {"width": 1200, "height": 630},
+		"format": "png",
+		"wait": {"selector": "#ready"}
+	}`)
+	m, err = LoadManifest("blog")
+	assert.NoError(t, err)
+	assert.Equal(t, Viewport{Width: 1200, Height: 630}, m.Viewport)
+	assert.Equal(t, "#ready", m.Wait.Selector)
+	assert.Equal(t, defaultWaitTimeout, m.Wait.Duration())
+
+	writeManifest(t, "broken", `{
+		"params": {"size": {"type": "date"}, "theme": {"enum": ["light", "dark"], "default": "blue"}},
+		"viewport": {"width": 50},
+		"format": "gif",
+		"wait": {"timeout": 60000}
+	}`)
+	_, err = LoadManifest("broken")
+	assert.True(t, errors.Is(err, ErrInvalidManifest))
+	assert.ErrorContains(t, err, `param size: invalid type "date"`)
+	assert.ErrorContains(t, err, "param theme: invalid default: must be one of [light dark]")
+	assert.ErrorContains(t, err, "invalid viewport 50x0")
+	assert.ErrorContains(t, err, `invalid format "gif"`)
+	assert.ErrorContains(t, err, "invalid wait timeout 60000")
+
+	writeManifest(t, "syntax", `{"params": `)
+	_, err = LoadManifest("syntax")
+	assert.True(t, errors.Is(err, ErrInvalidManifest))
+}
+
+func TestManifestApply(t *testing.T) {
+	m := &Manifest{
+		Params: map[string]Param{
+			"title": {Required: true, MaxLength: 5},
+			"count": {Type: "number"},
+			"dark":  {Type: "boolean"},
+			"img":   {Type: "image"},
+			"theme": {Enum: []string{"light", "dark"}, Default: "light"},
+		},
+		Format: "png",
+	}
+
+	params, err := m.Apply(url.Values{"url": {"example.com"}, "title": {"héllo"}, "count": {"1.5"}, "tracking": {"abc"}, "_regen_": {"key"}})
+	assert.NoError(t, err)
+	assert.Equal(t, url.Values{
+		"url":     {"example.com"},
+		"title":   {"héllo"},
+		"count":   {"1.5"},
+		"theme":   {"light"},
+		"format":  {"png"},
+		"_regen_": {"key"},
+	}, params)
+
+	_, err = m.Apply(url.Values{"count": {"many"}, "dark": {"maybe"}, "img": {"/local.png"}, "theme": {"blue"}})
+	var paramsErr *ParamsError
+	if assert.ErrorAs(t, err, &paramsErr) {
+		assert.Equal(t, []string{
+			"count must be a number",
+			"dark must be a boolean",
+			"img must be an http or https url",
+			"theme must be one of [light dark]",
+			"title is required",
+		}, paramsErr.Errors)
+	}
+
+	_, err = m.Apply(url.Values{"title": {"too long"}})
+	assert.ErrorContains(t, err, "title must be at most 5 characters")
+
+	// all params are kept if the manifest doesn't declare any
+	params = url.Values{"title": {"hello"}, "anything": {"goes"}}
+	assert.Equal(t, params, (&Manifest{}).Filter(params))
+}
@@ -0,0 +1,259 @@
+package templates
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/concurrency"
+	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/henrygd/social-image-server/internal/safehttp"
+)
+
+// path of the image proxy on the template server
+const proxyPath = "/_img"
+
+// how long proxied images are cached before they're fetched again
+const proxyCacheTime = 24 * time.Hour
+
+// client used to fetch remote images
+var proxyClient = safehttp.NewClient(15 * time.Second)
+
+// file extensions of the image types the proxy serves
+var proxyTypes = map[string]string{
+	"image/avif":    ".avif",
+	"image/gif":     ".gif",
+	"image/jpeg":    ".jpg",
+	"image/png":     ".png",
+	"image/svg+xml": ".svg",
+	"image/webp":    ".webp",
+}
+
+// extensions of the proxied images that templates rendered without the
+// browser can draw. svg and avif are only supported in the browser.
+var drawableTypes = []string{".gif", ".jpg", ".png", ".webp"}
+
+// Returned when a remote image can't be proxied
+var errProxyRejected = errors.New("image rejected")
+
+var proxySettings struct {
+	sync.RWMutex
+	enabled bool
+	domains []string
+	maxSize int64
+}
+
+// Sets whether remote images in template params are loaded through the image
+// proxy, the domains it fetches from (all public hosts if empty), and the
+// maximum size of an image.
+func SetImageProxy(enabled bool, domains []string, maxSize int64) {
+	proxySettings.Lock()
+	defer proxySettings.Unlock()
+	proxySettings.enabled = enabled
+	proxySettings.domains = domains
+	proxySettings.maxSize = maxSize
+}
+
+// Returns true if remote images are loaded through the image proxy
+func ImageProxyEnabled() bool {
+	proxySettings.RLock()
+	defer proxySettings.RUnlock()
+	return proxySettings.enabled
+}
+
+// checks a host against the proxy domains. Subdomains are allowed.
+func proxyAllowsHost(host string) bool {
+	proxySettings.RLock()
+	defer proxySettings.RUnlock()
+	if len(proxySettings.domains) == 0 {
+		return true
+	}
+	for _, domain := range proxySettings.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns params with remote image urls pointing at the image proxy. Params
+// declared as images in the manifest are rewritten, or every param with an
+// http url if the manifest doesn't declare params.
+func ProxyImages(manifest *Manifest, params url.Values) url.Values {
+	if !ImageProxyEnabled() {
+		return params
+	}
+	proxied := make(url.Values, len(params))
+	for key, values := range params {
+		proxied[key] = values
+		if slices.Contains(reservedParams, key) {
+			continue
+		}
+		if manifest != nil && manifest.Params != nil && manifest.Params[key].Type != "image" {
+			continue
+		}
+		proxied[key] = make([]string, len(values))
+		for i, value := range values {
+			if isRemoteURL(value) {
+				value = proxyPath + "?url=" + url.QueryEscape(value)
+			}
+			proxied[key][i] = value
+		}
+	}
+	return proxied
+}
+
+func isRemoteURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Returns the path of a cached copy of a remote image, fetching it through
+// the image proxy. Used by templates rendered without the browser, which
+// only load remote images if the proxy is enabled.
+func ProxiedImage(target string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil || !isRemoteURL(target) {
+		return "", fmt.Errorf("invalid image url %q", target)
+	}
+	if !proxyAllowsHost(u.Hostname()) {
+		return "", fmt.Errorf("image domain %s not allowed", u.Hostname())
+	}
+	path, err := proxyImage(target)
+	if err != nil {
+		return "", err
+	}
+	if ext := filepath.Ext(path); !slices.Contains(drawableTypes, ext) {
+		return "", fmt.Errorf("%w: %s images can only be used in html and svg templates", errProxyRejected, strings.TrimPrefix(ext, "."))
+	}
+	return path, nil
+}
+
+// serves a remote image from the proxy cache, fetching it if needed
+func handleProxy(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("url")
+	u, err := url.Parse(target)
+	if err != nil || !isRemoteURL(target) {
+		http.Error(w, "invalid url", http.StatusBadRequest)
+		return
+	}
+	if !proxyAllowsHost(u.Hostname()) {
+		http.Error(w, "domain not allowed", http.StatusForbidden)
+		return
+	}
+	path, err := proxyImage(target)
+	if err != nil {
+		slog.Warn("Error proxying image", "url", target, "error", err)
+		http.Error(w, "could not load image", http.StatusBadGateway)
+		return
+	}
+	// svg files can't run scripts on the template server
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, path)
+}
+
+// returns the path of a cached copy of a remote image, fetching it if it
+// isn't cached or has expired
+func proxyImage(target string) (string, error) {
+	hash := sha256.Sum256([]byte(target))
+	key := hex.EncodeToString(hash[:])
+	// one fetch at a time for each url
+	mutex := concurrency.GetOrCreateUrlMutex(proxyPath + key)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	cached, _ := filepath.Glob(filepath.Join(global.ProxyDir, key+".*"))
+	for _, path := range cached {
+		if stat, err := os.Stat(path); err == nil && time.Since(stat.ModTime()) < proxyCacheTime {
+			return path, nil
+		}
+	}
+	path, err := fetchImage(target, key)
+	if err != nil {
+		return "", err
+	}
+	for _, old := range cached {
+		if old != path {
+			os.Remove(old)
+		}
+	}
+	return path, nil
+}
+
+// downloads an image into the proxy directory, checking its type and size
+func fetchImage(target, key string) (string, error) {
+	proxySettings.RLock()
+	maxSize := proxySettings.maxSize
+	proxySettings.RUnlock()
+
+	res, err := proxyClient.Get(target)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: status %d", errProxyRejected, res.StatusCode)
+	}
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	extension, ok := proxyTypes[mediaType]
+	if !ok {
+		return "", fmt.Errorf("%w: content type %q", errProxyRejected, mediaType)
+	}
+	if maxSize > 0 && res.ContentLength > maxSize {
+		return "", fmt.Errorf("%w: larger than %d bytes", errProxyRejected, maxSize)
+	}
+
+	if err := os.MkdirAll(global.ProxyDir, 0755); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(global.ProxyDir, ".fetch-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	body := io.Reader(res.Body)
+	if maxSize > 0 {
+		body = io.LimitReader(res.Body, maxSize+1)
+	}
+	n, err := io.Copy(f, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if maxSize > 0 && n > maxSize {
+		return "", fmt.Errorf("%w: larger than %d bytes", errProxyRejected, maxSize)
+	}
+	path := filepath.Join(global.ProxyDir, key+extension)
+	return path, os.Rename(f.Name(), path)
+}
+
+// Removes proxied images that have expired
+func CleanProxyCache() {
+	entries, _ := os.ReadDir(global.ProxyDir)
+	removed := 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < proxyCacheTime {
+			continue
+		}
+		if os.Remove(filepath.Join(global.ProxyDir, entry.Name())) == nil {
+			removed++
+		}
+	}
+	slog.Debug("Cleaned image proxy cache", "removed", removed)
+}
@@ -0,0 +1,132 @@
+package templates
+
+import (
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyImages(t *testing.T) {
+	defer SetImageProxy(false, nil, 0)
+	params := url.Values{
+		"url":   {"https://example.com/post"},
+		"img":   {"https://cdn.example.com/a.jpg"},
+		"link":  {"https://example.com/about"},
+		"title": {"Hello"},
+	}
+	assert.Equal(t, params, ProxyImages(nil, params))
+
+	SetImageProxy(true, nil, 0)
+	proxied := ProxyImages(nil, params)
+	assert.Equal(t, "/_img?url="+url.QueryEscape("https://cdn.example.com/a.jpg"), proxied.Get("img"))
+	assert.Equal(t, "/_img?url="+url.QueryEscape("https://example.com/about"), proxied.Get("link"))
+	assert.Equal(t, "https://example.com/post", proxied.Get("url"))
+	assert.Equal(t, "Hello", proxied.Get("title"))
+	assert.Equal(t, "https://cdn.example.com/a.jpg", params.Get("img"))
+
+	// only params declared as images if the manifest declares params
+	manifest := &Manifest{Params: map[string]Param{"img": {Type: "image"}, "link": {}}}
+	proxied = ProxyImages(manifest, params)
+	assert.True(t, strings.HasPrefix(proxied.Get("img"), proxyPath))
+	assert.Equal(t, "https://example.com/about", proxied.Get("link"))
+}
+
+func TestImageProxy(t *testing.T) {
+	global.ProxyDir = t.TempDir()
+	defer SetImageProxy(false, nil, 0)
+	SetImageProxy(true, []string{"127.0.0.1"}, 20)
+	// test server is on a loopback address
+	defer func(client *http.Client) { proxyClient = client }(proxyClient)
+	proxyClient = http.DefaultClient
+
+	fetches := 0
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		switch r.URL.Path {
+		case "/image.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("not really a png"))
+		case "/large.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(strings.Repeat("x", 21)))
+		case "/page.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<script></script>"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer origin.Close()
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		Handler().ServeHTTP(rr, httptest.NewRequest("GET", proxyPath+"?url="+url.QueryEscape(target), nil))
+		return rr
+	}
+
+	rr := get(origin.URL + "/image.png")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "image/png", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "not really a png", rr.Body.String())
+	// served from the cache
+	get(origin.URL + "/image.png")
+	assert.Equal(t, 1, fetches)
+
+	// fetched again once expired
+	entries, _ := os.ReadDir(global.ProxyDir)
+	if assert.Len(t, entries, 1) {
+		old := time.Now().Add(-proxyCacheTime)
+		os.Chtimes(filepath.Join(global.ProxyDir, entries[0].Name()), old, old)
+	}
+	assert.Equal(t, http.StatusOK, get(origin.URL+"/image.png").Code)
+	assert.Equal(t, 2, fetches)
+
+	assert.Equal(t, http.StatusBadGateway, get(origin.URL+"/large.png").Code)
+	assert.Equal(t, http.StatusBadGateway, get(origin.URL+"/page.html").Code)
+	assert.Equal(t, http.StatusBadGateway, get(origin.URL+"/missing.png").Code)
+	assert.Equal(t, http.StatusBadRequest, get("file:///etc/passwd").Code)
+	assert.Equal(t, http.StatusForbidden, get("https://example.com/image.png").Code)
+
+	// only the valid image is cached
+	entries, _ = os.ReadDir(global.ProxyDir)
+	assert.Len(t, entries, 1)
+	old := time.Now().Add(-proxyCacheTime)
+	os.Chtimes(filepath.Join(global.ProxyDir, entries[0].Name()), old, old)
+	CleanProxyCache()
+	entries, _ = os.ReadDir(global.ProxyDir)
+	assert.Empty(t, entries)
+}
+
+func TestProxiedImage(t *testing.T) {
+	global.ProxyDir = t.TempDir()
+	defer SetImageProxy(false, nil, 0)
+	SetImageProxy(true, []string{"127.0.0.1"}, 0)
+	defer func(client *http.Client) { proxyClient = client }(proxyClient)
+	proxyClient = http.DefaultClient
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", mime.TypeByExtension(filepath.Ext(r.URL.Path)))
+		w.Write([]byte("image"))
+	}))
+	defer origin.Close()
+
+	path, err := ProxiedImage(origin.URL + "/image.webp")
+	assert.NoError(t, err)
+	assert.Equal(t, ".webp", filepath.Ext(path))
+
+	// cards can't draw svg images, which are only for the browser
+	_, err = ProxiedImage(origin.URL + "/image.svg")
+	assert.ErrorIs(t, err, errProxyRejected)
+	assert.ErrorContains(t, err, "svg images can only be used in html and svg templates")
+
+	_, err = ProxiedImage("https://example.com/image.png")
+	assert.ErrorContains(t, err, "image domain example.com not allowed")
+}
@@ -0,0 +1,143 @@
+package templates
+
+import (
+	"bytes"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// name of the optional server-rendered index page in a template directory
+const IndexTemplate = "index.html.tmpl"
+
+// Data passed to index.html.tmpl
+type PageData struct {
+	// name of the template
+	Name string
+	// first value of each request param. missing params are empty strings.
+	Params map[string]string
+	// all values of each request param
+	Values url.Values
+}
+
+// executes index.html.tmpl if the template has one. Returns false if it doesn't.
+func renderIndex(w http.ResponseWriter, r *http.Request, name, dir string) bool {
+	page, ok, err := executeIndex(name, dir, r.URL.Query())
+	if !ok {
+		return false
+	}
+	if err != nil {
+		slog.Error("Error rendering template", "template", name, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(page)
+	return true
+}
+
+// Executes a template's index.html.tmpl with the params, so templates that
+// fail for a request fail before the page is loaded. Templates without one
+// always pass.
+func CheckIndex(name string, params url.Values) error {
+	dir, ok := Dir(name)
+	if !ok {
+		return fs.ErrNotExist
+	}
+	_, _, err := executeIndex(name, dir, params)
+	return err
+}
+
+// parses index.html.tmpl and the other .tmpl files in dir, which can be used
+// as partials. Returns false if the template doesn't have one.
+func parseIndex(name, dir string) (*template.Template, bool, error) {
+	if _, err := os.Stat(filepath.Join(dir, IndexTemplate)); err != nil {
+		return nil, false, nil
+	}
+	var files []string
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".tmpl") {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	tmpl, err := template.New(IndexTemplate).Option("missingkey=zero").Funcs(funcMap(name)).ParseFiles(files...)
+	return tmpl, true, err
+}
+
+// executes index.html.tmpl with the params. Returns false if the template
+// doesn't have one.
+func executeIndex(name, dir string, params url.Values) ([]byte, bool, error) {
+	tmpl, ok, err := parseIndex(name, dir)
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+	data := PageData{Name: name, Params: map[string]string{}, Values: params}
+	for key := range data.Values {
+		data.Params[key] = data.Values.Get(key)
+	}
+	// render to a buffer so errors don't leave a partial page
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, IndexTemplate, data); err != nil {
+		return nil, true, err
+	}
+	return buf.Bytes(), true, nil
+}
+
+// returns the helper functions available in index.html.tmpl
+func funcMap(name string) template.FuncMap {
+	return template.FuncMap{
+		// shortens s to at most n characters, ending with an ellipsis
+		"truncate": func(n int, s string) string {
+			if n < 1 || utf8.RuneCountInString(s) <= n {
+				return s
+			}
+			runes := []rune(s)
+			return strings.TrimSpace(string(runes[:n-1])) + "…"
+		},
+		// formats a date param using a Go layout like "Jan 2, 2006"
+		"date": func(layout, value string) string {
+			if t, ok := parseDate(value); ok {
+				return t.Format(layout)
+			}
+			return value
+		},
+		// returns value, or def if value is empty
+		"default": func(def, value string) string {
+			if value == "" {
+				return def
+			}
+			return value
+		},
+		"upper":     strings.ToUpper,
+		"lower":     strings.ToLower,
+		"urlescape": url.QueryEscape,
+		// returns the url of a file in the template directory
+		"asset": func(file string) string {
+			return pathPrefix + url.PathEscape(name) + path.Clean("/"+file)
+		},
+	}
+}
+
+// parses RFC 3339 timestamps, dates and unix timestamps in seconds
+func parseDate(value string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,174 @@
+package templates
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/henrygd/social-image-server/internal/card"
+)
+
+// name of the svg file in an svg template directory
+const SVGFile = "index.svg"
+
+// Returns the path of a template's index.svg if it has one instead of html
+// or a card. SVG templates are loaded in the browser at the size of their
+// viewBox.
+func SVGPath(name string) (string, bool) {
+	dir, ok := Dir(name)
+	if !ok || fileExists(filepath.Join(dir, "index.html")) || fileExists(filepath.Join(dir, IndexTemplate)) || fileExists(filepath.Join(dir, card.File)) {
+		return "", false
+	}
+	path := filepath.Join(dir, SVGFile)
+	return path, fileExists(path)
+}
+
+// Returns the size of an svg from the viewBox of its root element, or its
+// width and height if it has no viewBox. Also checks where the svg has
+// placeholders (see checkPlaceholders).
+func SVGSize(path string) (Viewport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Viewport{}, err
+	}
+	defer f.Close()
+	return parseSVG(f)
+}
+
+// reads the size of an svg and checks its placeholders
+func parseSVG(r io.Reader) (Viewport, error) {
+	decoder := xml.NewDecoder(r)
+	var size Viewport
+	var found bool
+	// local names of the open elements
+	var open []string
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Viewport{}, fmt.Errorf("%s: %w", SVGFile, err)
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			if !found {
+				found = true
+				if token.Name.Local != "svg" {
+					return Viewport{}, fmt.Errorf("%s: root element is %s, not svg", SVGFile, token.Name.Local)
+				}
+				if size, err = svgElementSize(token); err != nil {
+					return Viewport{}, fmt.Errorf("%s: %w", SVGFile, err)
+				}
+			}
+			open = append(open, strings.ToLower(token.Name.Local))
+			for _, attr := range token.Attr {
+				if err := checkPlaceholders(open, strings.ToLower(attr.Name.Local), attr.Value); err != nil {
+					return Viewport{}, err
+				}
+			}
+		case xml.EndElement:
+			open = open[:len(open)-1]
+		case xml.CharData:
+			if err := checkPlaceholders(open, "", string(token)); err != nil {
+				return Viewport{}, err
+			}
+		}
+	}
+	if !found {
+		return Viewport{}, fmt.Errorf("%s: missing svg element", SVGFile)
+	}
+	if size.Width < 200 || size.Width > 2400 || size.Height < 100 || size.Height > 2400 {
+		return Viewport{}, fmt.Errorf("%s: invalid size %dx%d (width 200-2400, height 100-2400)", SVGFile, size.Width, size.Height)
+	}
+	return size, nil
+}
+
+// placeholders are xml escaped, which doesn't stop a value from adding script
+// or css once the browser decodes it. Values can't go in script or style
+// elements, or in event handler and style attributes.
+func checkPlaceholders(open []string, attr, value string) error {
+	if !card.HasPlaceholder(value) {
+		return nil
+	}
+	for _, name := range open {
+		if name == "script" || name == "style" {
+			return fmt.Errorf("%s: placeholders aren't allowed in %s elements", SVGFile, name)
+		}
+	}
+	if attr == "style" || strings.HasPrefix(attr, "on") {
+		return fmt.Errorf("%s: placeholders aren't allowed in %s attributes", SVGFile, attr)
+	}
+	return nil
+}
+
+// reads the size of an svg root element in css pixels
+func svgElementSize(start xml.StartElement) (Viewport, error) {
+	var viewBox, width, height string
+	for _, attr := range start.Attr {
+		switch attr.Name.Local {
+		case "viewBox":
+			viewBox = attr.Value
+		case "width":
+			width = attr.Value
+		case "height":
+			height = attr.Value
+		}
+	}
+	if viewBox != "" {
+		fields := strings.FieldsFunc(viewBox, func(r rune) bool { return r == ' ' || r == ',' })
+		if len(fields) != 4 {
+			return Viewport{}, fmt.Errorf("invalid viewBox %q", viewBox)
+		}
+		w, errW := strconv.ParseFloat(fields[2], 64)
+		h, errH := strconv.ParseFloat(fields[3], 64)
+		if errW != nil || errH != nil {
+			return Viewport{}, fmt.Errorf("invalid viewBox %q", viewBox)
+		}
+		return Viewport{Width: int64(math.Round(w)), Height: int64(math.Round(h))}, nil
+	}
+	w, errW := strconv.ParseFloat(strings.TrimSuffix(width, "px"), 64)
+	h, errH := strconv.ParseFloat(strings.TrimSuffix(height, "px"), 64)
+	if errW != nil || errH != nil {
+		return Viewport{}, errors.New("svg needs a viewBox or width and height in pixels")
+	}
+	return Viewport{Width: int64(math.Round(w)), Height: int64(math.Round(h))}, nil
+}
+
+// escapes a param value for svg text and attributes
+func escapeSVG(value string) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(value))
+	return escaped.String()
+}
+
+// serves index.svg with the request params filled in. Returns false if the
+// template doesn't have one.
+func renderSVG(w http.ResponseWriter, r *http.Request, name string) bool {
+	path, ok := SVGPath(name)
+	if !ok {
+		return false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	// the file may have been edited since it was checked
+	if _, err := parseSVG(bytes.NewReader(data)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	w.Header().Set("Content-Type", "image/svg+xml; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, card.Expand(string(data), r.URL.Query(), escapeSVG))
+	return true
+}
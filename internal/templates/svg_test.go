@@ -0,0 +1,111 @@
+package templates
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSVGTemplate(t *testing.T) {
+	global.TemplateDir = t.TempDir()
+	dir := filepath.Join(global.TemplateDir, "vector")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, SVGFile), []byte(
+		`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 1200 630"><text>{{title}} by {{ author }}{{missing}}</text></svg>`,
+	), 0644)
+
+	path, ok := SVGPath("vector")
+	assert.True(t, ok)
+	size, err := SVGSize(path)
+	assert.NoError(t, err)
+	assert.Equal(t, Viewport{Width: 1200, Height: 630}, size)
+
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+	res, err := http.Get(server.URL + "/_tpl/vector/?title=" + url.QueryEscape(`<tspan>"A & B"</tspan>`) + "&author=me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, "image/svg+xml; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Equal(t,
+		`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 1200 630"><text>&lt;tspan&gt;&#34;A &amp; B&#34;&lt;/tspan&gt; by me</text></svg>`,
+		string(body),
+	)
+
+	// values can't close the element they're in to add script or css
+	res, err = http.Get(server.URL + "/_tpl/vector/?title=" + url.QueryEscape(`</text><style>*{fill:red}</style><script>alert(1)</script>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NotContains(t, string(body), "<style>")
+	assert.NotContains(t, string(body), "<script>")
+
+	// html takes precedence over svg
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("html"), 0644)
+	_, ok = SVGPath("vector")
+	assert.False(t, ok)
+}
+
+func TestSVGSize(t *testing.T) {
+	for svg, expected := range map[string]any{
+		`<?xml version="1.0"?><!-- card --><svg viewBox="0,0,800.4,418.6"/>`: Viewport{Width: 800, Height: 419},
+		`<svg width="1200px" height="630"/>`:                                 Viewport{Width: 1200, Height: 630},
+		`<svg width="100%" height="100%"/>`:                                  "needs a viewBox",
+		`<svg viewBox="0 0 1200"/>`:                                          "invalid viewBox",
+		`<svg viewBox="0 0 5000 630"/>`:                                      "invalid size 5000x630",
+		`<html></html>`:                                                      "root element is html",
+		`not xml`:                                                            "missing svg element",
+	} {
+		path := filepath.Join(t.TempDir(), SVGFile)
+		os.WriteFile(path, []byte(svg), 0644)
+		size, err := SVGSize(path)
+		if msg, ok := expected.(string); ok {
+			assert.ErrorContains(t, err, msg, svg)
+		} else {
+			assert.NoError(t, err, svg)
+			assert.Equal(t, expected, size, svg)
+		}
+	}
+}
+
+func TestSVGPlaceholders(t *testing.T) {
+	global.TemplateDir = t.TempDir()
+	dir := filepath.Join(global.TemplateDir, "vector")
+	os.MkdirAll(dir, 0755)
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+
+	for svg, expected := range map[string]string{
+		`<svg viewBox="0 0 1200 630"><text fill="{{color}}">{{title}}</text><!-- {{note}} --></svg>`: "",
+		`<svg viewBox="0 0 1200 630"><style>text { fill: {{color}} }</style></svg>`:                  "aren't allowed in style elements",
+		`<svg viewBox="0 0 1200 630"><script><![CDATA[var title = "{{title}}"]]></script></svg>`:     "aren't allowed in script elements",
+		`<svg viewBox="0 0 1200 630"><foreignObject><style>{{css}}</style></foreignObject></svg>`:    "aren't allowed in style elements",
+		`<svg viewBox="0 0 1200 630"><text onclick="show('{{title}}')">{{title}}</text></svg>`:       "aren't allowed in onclick attributes",
+		`<svg viewBox="0 0 1200 630"><text style="fill: {{color}}">{{title}}</text></svg>`:           "aren't allowed in style attributes",
+		`<svg viewBox="0 0 1200 630"><script href="{{src}}"/></svg>`:                                 "aren't allowed in script elements",
+	} {
+		os.WriteFile(filepath.Join(dir, SVGFile), []byte(svg), 0644)
+		_, err := SVGSize(filepath.Join(dir, SVGFile))
+		res, _ := http.Get(server.URL + "/_tpl/vector/?color=" + url.QueryEscape(`red}</style><script>alert(1)</script>`))
+		res.Body.Close()
+		if expected == "" {
+			assert.NoError(t, err, svg)
+			assert.Equal(t, http.StatusOK, res.StatusCode, svg)
+		} else {
+			assert.ErrorContains(t, err, expected, svg)
+			// templates edited after they were checked aren't served either
+			assert.Equal(t, http.StatusInternalServerError, res.StatusCode, svg)
+		}
+	}
+}
@@ -1,51 +1,159 @@
 package templates
 
 import (
-	"log"
+	"crypto/sha256"
+	"encoding/hex"
 	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/henrygd/social-image-server/internal/card"
 	"github.com/henrygd/social-image-server/internal/global"
 )
 
-func TempServer(templateName string) (server *http.Server, serverURL string, err error) {
-	slog.Debug("Starting temp server", "template", templateName)
-	// Serve static files from template directory
-	fs := http.FileServer(http.Dir(filepath.Join(global.TemplateDir, templateName)))
-	// Create a new ServeMux and handle root path
-	router := http.NewServeMux()
-	router.Handle("/", fs)
+// path prefix that templates are served under
+const pathPrefix = "/_tpl/"
 
-	// Create a listener on a random port
-	listener, err := net.Listen("tcp", ":0")
+// template names by the host label they're served under
+var hosts sync.Map
+
+// loopback server shared by all template renders
+var server struct {
+	sync.Mutex
+	url string
+}
+
+// Returns the url of a template on the template server, starting the server
+// if it isn't running.
+//
+// Each template is served at the root of its own *.localhost host, which the
+// browser resolves to the loopback server, so root-relative paths in any file
+// of the render load from the template.
+func URL(templateName string) (string, error) {
+	serverURL, err := startServer()
 	if err != nil {
-		return nil, "", err
+		return "", err
 	}
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(serverURL, "http://"))
+	if err != nil {
+		return "", err
+	}
+	label := hostLabel(templateName)
+	hosts.Store(label, templateName)
+	return "http://" + label + ".localhost:" + port + "/", nil
+}
+
+// returns the host label for a template. Hosts are case insensitive and
+// limited in length, so names are hashed.
+func hostLabel(templateName string) string {
+	hash := sha256.Sum256([]byte(templateName))
+	return "t" + hex.EncodeToString(hash[:10])
+}
 
-	server = &http.Server{
-		Addr:    listener.Addr().String(),
-		Handler: router,
+// returns the template served at the request host, if any
+func hostTemplate(r *http.Request) (string, bool) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	label, ok := strings.CutSuffix(strings.ToLower(host), ".localhost")
+	if !ok {
+		return "", false
+	}
+	name, ok := hosts.Load(label)
+	if !ok {
+		return "", false
 	}
+	return name.(string), true
+}
 
-	// Start the server in a new goroutine
+// starts the template server on a random loopback port if it isn't running
+func startServer() (string, error) {
+	server.Lock()
+	defer server.Unlock()
+	if server.url != "" {
+		return server.url, nil
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	srv := &http.Server{Handler: Handler(), ReadHeaderTimeout: 10 * time.Second}
+	server.url = "http://" + listener.Addr().String()
+	slog.Debug("Started template server", "url", server.url)
 	go func() {
-		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server ListenAndServe(): %v", err)
-		}
+		err := srv.Serve(listener)
+		slog.Error("Template server stopped", "error", err)
+		// started again on the next render
+		server.Lock()
+		server.url = ""
+		server.Unlock()
 	}()
+	return server.url, nil
+}
 
-	return server, "http://" + server.Addr, nil
+// Returns the handler that serves template files at the root of each
+// template's host (see URL), or from /_tpl/{name}/ on any host.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == proxyPath {
+			handleProxy(w, r)
+			return
+		}
+		name, filePath, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, pathPrefix), "/")
+		if !ok || !strings.HasPrefix(r.URL.Path, pathPrefix) {
+			if name, ok = hostTemplate(r); !ok {
+				http.NotFound(w, r)
+				return
+			}
+			filePath = strings.TrimPrefix(r.URL.Path, "/")
+		}
+		dir, ok := Dir(name)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if (filePath == "" || filePath == "index.html") && renderIndex(w, r, name, dir) {
+			return
+		}
+		if filePath == "" && renderSVG(w, r, name) {
+			return
+		}
+		r.URL.Path = "/" + filePath
+		http.FileServer(http.Dir(dir)).ServeHTTP(w, r)
+	})
+}
+
+// Returns the path of a template's card.json if it has one instead of html.
+// Card templates are drawn without the browser.
+func CardPath(name string) (string, bool) {
+	dir, ok := Dir(name)
+	if !ok || fileExists(filepath.Join(dir, "index.html")) || fileExists(filepath.Join(dir, IndexTemplate)) {
+		return "", false
+	}
+	path := filepath.Join(dir, card.File)
+	return path, fileExists(path)
 }
 
+// Checks if a template exists. Name can include a version ("name@version").
 func IsValid(templateName string) bool {
+	_, ok := Dir(templateName)
+	return ok
+}
+
+// Returns the names of all templates
+func List() []string {
 	entries, _ := os.ReadDir(global.TemplateDir)
+	names := make([]string, 0, len(entries))
 	for _, entry := range entries {
-		if entry.Name() == templateName {
-			return true
+		if _, ok := currentDir(entry.Name()); ok {
+			names = append(names, entry.Name())
 		}
 	}
-	return false
+	return names
 }
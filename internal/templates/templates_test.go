@@ -0,0 +1,114 @@
+package templates
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer(t *testing.T) {
+	global.TemplateDir = t.TempDir()
+	os.MkdirAll(filepath.Join(global.TemplateDir, "blog", "assets"), 0755)
+	os.MkdirAll(filepath.Join(global.TemplateDir, "blog", "fonts"), 0755)
+	os.WriteFile(filepath.Join(global.TemplateDir, "blog", "index.html"), []byte("blog"), 0644)
+	os.WriteFile(filepath.Join(global.TemplateDir, "blog", "assets", "app.js"), []byte("app"), 0644)
+	os.WriteFile(filepath.Join(global.TemplateDir, "blog", "assets", "app.css"), []byte(`@font-face { src: url(/fonts/inter.woff2) }`), 0644)
+	os.WriteFile(filepath.Join(global.TemplateDir, "blog", "fonts", "inter.woff2"), []byte("font"), 0644)
+	os.WriteFile(filepath.Join(global.TemplateDir, "secret.txt"), []byte("secret"), 0644)
+
+	blogURL, err := URL("blog")
+	assert.NoError(t, err)
+	parsed, _ := url.Parse(blogURL)
+	assert.Regexp(t, `^t[0-9a-f]{20}\.localhost$`, parsed.Hostname())
+	assert.Equal(t, "/", parsed.Path)
+	// server is reused, with a host for each template
+	otherURL, _ := URL("other")
+	other, _ := url.Parse(otherURL)
+	assert.Equal(t, parsed.Port(), other.Port())
+	assert.NotEqual(t, parsed.Hostname(), other.Hostname())
+	root := "http://127.0.0.1:" + parsed.Port()
+
+	// *.localhost resolves to the loopback server in the browser
+	get := func(host, path string) (int, string) {
+		req, _ := http.NewRequest("GET", root+path, nil)
+		req.Host = host
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	status, body := get(parsed.Host, "/?title=hello")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "blog", body)
+	// root-relative paths load from the template without a referer, including
+	// files loaded by other files
+	_, body = get(parsed.Host, "/assets/app.css")
+	assert.Contains(t, body, "url(/fonts/inter.woff2)")
+	status, body = get(parsed.Host, "/fonts/inter.woff2")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "font", body)
+	// the path prefix works on any host
+	_, body = get(parsed.Host, "/_tpl/blog/assets/app.js")
+	assert.Equal(t, "app", body)
+	_, body = get("127.0.0.1", "/_tpl/blog/assets/app.js")
+	assert.Equal(t, "app", body)
+
+	for host, paths := range map[string][]string{
+		parsed.Host:         {"/../secret.txt", "/%2e%2e/secret.txt", "/_tpl/missing/"},
+		other.Host:          {"/", "/assets/app.js"},
+		"unknown.localhost": {"/assets/app.js"},
+		"127.0.0.1":         {"/assets/app.js", "/_tpl/blog/../secret.txt", "/_tpl/blog/%2e%2e/secret.txt"},
+	} {
+		for _, path := range paths {
+			status, body = get(host, path)
+			assert.NotEqual(t, http.StatusOK, status, host+path)
+			assert.NotEqual(t, "secret", body, host+path)
+		}
+	}
+}
+
+func TestRenderIndex(t *testing.T) {
+	global.TemplateDir = t.TempDir()
+	dir := filepath.Join(global.TemplateDir, "card")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "index.html.tmpl"), []byte(
+		`<h1>{{truncate 8 .Params.title}}</h1>`+
+			`<p>{{date "Jan 2, 2006" .Params.date}}</p>`+
+			`<p>{{default "light" .Params.theme | upper}}</p>`+
+			`{{range .Values.tag}}<i>{{.}}</i>{{end}}`+
+			`<img src="{{asset "logo.png"}}">{{template "footer.tmpl" .}}`,
+	), 0644)
+	os.WriteFile(filepath.Join(dir, "footer.tmpl"), []byte(`<footer>{{.Name}}</footer>`), 0644)
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/_tpl/card/?title=" + url.QueryEscape("<b>Hello world</b>") + "&date=2024-03-05&tag=a&tag=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Equal(t,
+		`<h1>&lt;b&gt;Hell…</h1><p>Mar 5, 2024</p><p>LIGHT</p><i>a</i><i>b</i><img src="/_tpl/card/logo.png"><footer>card</footer>`,
+		string(body),
+	)
+
+	// errors are shown on the page
+	os.WriteFile(filepath.Join(dir, "index.html.tmpl"), []byte(`{{.Missing`), 0644)
+	res, _ = http.Get(server.URL + "/_tpl/card/")
+	res.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+}
@@ -0,0 +1,255 @@
+package templates
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/global"
+)
+
+// directory in TemplateDir holding previous versions of uploaded templates
+const versionsDir = ".versions"
+
+// number of previous versions kept for each template
+var keepVersions = 5
+
+// versions are the first 12 hex characters of the content hash
+const VersionLength = 12
+
+var versionRegex = regexp.MustCompile(`^[0-9a-f]{12}$`)
+
+// how often templates created by hand are checked for changed files
+var versionCheckInterval = 10 * time.Second
+
+// content hashes of template directories created by hand. Files are checked
+// for changes at most every versionCheckInterval, and hashed again if their
+// sizes or times changed.
+var versionCache = struct {
+	sync.Mutex
+	entries map[string]versionEntry
+}{entries: map[string]versionEntry{}}
+
+type versionEntry struct {
+	fingerprint string
+	version     string
+	checked     time.Time
+}
+
+// Forgets the versions of templates created by hand, so changes to their
+// files are picked up on the next request
+func Refresh() {
+	versionCache.Lock()
+	defer versionCache.Unlock()
+	clear(versionCache.entries)
+}
+
+// Splits "name@version" into the template name and version.
+// Version is empty for the current version.
+func SplitName(name string) (base, version string) {
+	base, version, _ = strings.Cut(name, "@")
+	return base, version
+}
+
+// Returns the directory of a template. Name can include a version
+// ("name@version") to get a previous version of an uploaded template.
+func Dir(name string) (string, bool) {
+	base, version := SplitName(name)
+	current, ok := currentDir(base)
+	if !ok {
+		return "", false
+	}
+	if version == "" {
+		return current, true
+	}
+	if !versionRegex.MatchString(version) {
+		return "", false
+	}
+	if v, err := dirVersion(base, current); err == nil && v == version {
+		return current, true
+	}
+	previous := filepath.Join(global.TemplateDir, versionsDir, base, version)
+	if isDir(previous) {
+		return previous, true
+	}
+	return "", false
+}
+
+// returns the directory a template is served from. Uploaded templates are
+// links to their current version in the versions directory, and templates
+// created by hand are plain directories.
+func currentDir(name string) (string, bool) {
+	// names can't point outside TemplateDir
+	if name == "" || strings.HasPrefix(name, ".") || filepath.Base(name) != name {
+		return "", false
+	}
+	path := filepath.Join(global.TemplateDir, name)
+	stat, err := os.Lstat(path)
+	if err != nil {
+		return "", false
+	}
+	if stat.IsDir() {
+		return path, true
+	}
+	if stat.Mode()&fs.ModeSymlink == 0 {
+		return "", false
+	}
+	// links are only followed to versions of the same template
+	target, err := os.Readlink(path)
+	if err != nil || filepath.Dir(target) != filepath.Join(versionsDir, name) || !versionRegex.MatchString(filepath.Base(target)) {
+		return "", false
+	}
+	dir := filepath.Join(global.TemplateDir, target)
+	return dir, isDir(dir)
+}
+
+func isDir(path string) bool {
+	stat, err := os.Stat(path)
+	return err == nil && stat.IsDir()
+}
+
+// Returns the current version of a template, a hash of its file names and
+// contents. Uploaded versions are named by their hash, and templates created
+// by hand are hashed again only when their files change.
+func Version(name string) (string, error) {
+	dir, ok := Dir(name)
+	if !ok {
+		return "", fs.ErrNotExist
+	}
+	base, _ := SplitName(name)
+	return dirVersion(base, dir)
+}
+
+// returns the version of a template directory. Uploaded versions are named
+// by their hash, so only templates created by hand are hashed.
+func dirVersion(name, dir string) (string, error) {
+	if filepath.Dir(dir) == filepath.Join(global.TemplateDir, versionsDir, name) {
+		return filepath.Base(dir), nil
+	}
+	versionCache.Lock()
+	entry, ok := versionCache.entries[dir]
+	versionCache.Unlock()
+	if ok && time.Since(entry.checked) < versionCheckInterval {
+		return entry.version, nil
+	}
+	files, fingerprint, err := walkFiles(dir)
+	if err != nil {
+		return "", err
+	}
+	if !ok || entry.fingerprint != fingerprint {
+		if entry.version, err = hashFiles(dir, files); err != nil {
+			return "", err
+		}
+	}
+	entry.fingerprint, entry.checked = fingerprint, time.Now()
+	versionCache.Lock()
+	versionCache.entries[dir] = entry
+	versionCache.Unlock()
+	return entry.version, nil
+}
+
+// forgets the cached version of a template created by hand
+func forgetVersion(name string) {
+	versionCache.Lock()
+	defer versionCache.Unlock()
+	delete(versionCache.entries, filepath.Join(global.TemplateDir, name))
+}
+
+// returns the version of the files in a directory
+func hashDir(dir string) (string, error) {
+	files, _, err := walkFiles(dir)
+	if err != nil {
+		return "", err
+	}
+	return hashFiles(dir, files)
+}
+
+func hashFiles(dir string, files []string) (string, error) {
+	h := sha256.New()
+	for _, file := range files {
+		fmt.Fprintf(h, "%s\x00", file)
+		if err := hashFile(h, filepath.Join(dir, file)); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:VersionLength], nil
+}
+
+// returns the sorted relative paths of regular files in dir and a
+// fingerprint of their sizes and modification times
+func walkFiles(dir string) (files []string, fingerprint string, err error) {
+	h := sha256.New()
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		rel = filepath.ToSlash(rel)
+		files = append(files, rel)
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00", rel, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	sort.Strings(files)
+	return files, hex.EncodeToString(h.Sum(nil)), err
+}
+
+func hashFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Returns the previous versions of a template, newest first
+func PreviousVersions(name string) []string {
+	archive := filepath.Join(global.TemplateDir, versionsDir, name)
+	entries, _ := os.ReadDir(archive)
+	current, _ := currentDir(name)
+	type previous struct {
+		version string
+		modTime int64
+	}
+	var found []previous
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !entry.IsDir() || !versionRegex.MatchString(entry.Name()) || filepath.Join(archive, entry.Name()) == current {
+			continue
+		}
+		found = append(found, previous{entry.Name(), info.ModTime().UnixNano()})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].modTime > found[j].modTime })
+	versions := make([]string, len(found))
+	for i, p := range found {
+		versions[i] = p.version
+	}
+	return versions
+}
+
+// marks a version as replaced now and removes the oldest previous versions
+// beyond keepVersions
+func retireVersion(name, dir string) {
+	// mark when the version was replaced for ordering
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+	if versions := PreviousVersions(name); len(versions) > keepVersions {
+		for _, old := range versions[keepVersions:] {
+			os.RemoveAll(filepath.Join(global.TemplateDir, versionsDir, name, old))
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package warmup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPruneJobs(t *testing.T) {
+	jobsLock.Lock()
+	clear(jobs)
+	defer func() {
+		jobsLock.Lock()
+		clear(jobs)
+		jobsLock.Unlock()
+	}()
+	old, recent, running := New(Options{}), New(Options{}), New(Options{})
+	old.Finished = time.Now().Add(-finishedJobTTL - time.Minute)
+	recent.Finished = time.Now()
+	for _, job := range []*Job{old, recent, running} {
+		jobs[job.ID] = job
+	}
+	jobsLock.Unlock()
+
+	// finished jobs are dropped after finishedJobTTL, running jobs are kept
+	assert.Nil(t, Get(old.ID))
+	assert.Equal(t, recent, Get(recent.ID))
+	assert.Equal(t, running, Get(running.ID))
+	assert.Len(t, List(), 2)
+}
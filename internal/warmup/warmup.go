@@ -0,0 +1,329 @@
+package warmup
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/scraper"
+	"golang.org/x/net/html"
+)
+
+// max depth of nested sitemap indexes
+const maxSitemapDepth = 3
+
+// max number of pages collected from a sitemap
+const maxPages = 50000
+
+// max number of errors kept on a job
+const maxJobErrors = 20
+
+// Renders the image for an og:image url if it isn't already cached.
+// Returns true if a new image was rendered.
+type RenderFunc func(ogImageURL *url.URL) (rendered bool, err error)
+
+// Options for a warm-up job
+type Options struct {
+	// url of sitemap.xml or sitemap index
+	Sitemap string `json:"sitemap"`
+	// host of og:image urls that point at this server
+	Host string `json:"host"`
+	// number of pages processed at once
+	Concurrency int `json:"concurrency"`
+}
+
+// Progress of a warm-up job. Counters are safe to read while the job runs.
+type Job struct {
+	ID       string    `json:"id"`
+	Options  Options   `json:"options"`
+	Status   string    `json:"status"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Total    int64     `json:"total"`
+	Done     int64     `json:"done"`
+	Rendered int64     `json:"rendered"`
+	Skipped  int64     `json:"skipped"`
+	Failed   int64     `json:"failed"`
+	Errors   []string  `json:"errors"`
+	mu       sync.Mutex
+}
+
+// job statuses
+const (
+	StatusRunning  = "running"
+	StatusFinished = "finished"
+	StatusFailed   = "failed"
+)
+
+// how long finished jobs are kept
+var finishedJobTTL = 24 * time.Hour
+
+var jobs = make(map[string]*Job)
+var jobsLock sync.Mutex
+
+// Creates a job and runs it in the background
+func Start(opts Options, render RenderFunc) *Job {
+	job := New(opts)
+	jobsLock.Lock()
+	pruneJobs()
+	jobs[job.ID] = job
+	jobsLock.Unlock()
+	go job.Run(context.Background(), render)
+	return job
+}
+
+// Returns the job with the given id, or nil if it doesn't exist
+func Get(id string) *Job {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	pruneJobs()
+	return jobs[id]
+}
+
+// Returns snapshots of all jobs
+func List() []*Job {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	pruneJobs()
+	list := make([]*Job, 0, len(jobs))
+	for _, job := range jobs {
+		list = append(list, job.Snapshot())
+	}
+	return list
+}
+
+// removes jobs that finished more than finishedJobTTL ago. jobsLock must be held.
+func pruneJobs() {
+	for id, job := range jobs {
+		job.mu.Lock()
+		finished := job.Finished
+		job.mu.Unlock()
+		if !finished.IsZero() && time.Since(finished) > finishedJobTTL {
+			delete(jobs, id)
+		}
+	}
+}
+
+// Creates a job without registering or starting it. Use Run to run it in the foreground.
+func New(opts Options) *Job {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &Job{ID: hex.EncodeToString(id), Options: opts, Status: StatusRunning, Started: time.Now()}
+}
+
+// Returns a copy of the job that is safe to serialize
+func (job *Job) Snapshot() *Job {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return &Job{
+		ID:       job.ID,
+		Options:  job.Options,
+		Status:   job.Status,
+		Started:  job.Started,
+		Finished: job.Finished,
+		Total:    atomic.LoadInt64(&job.Total),
+		Done:     atomic.LoadInt64(&job.Done),
+		Rendered: atomic.LoadInt64(&job.Rendered),
+		Skipped:  atomic.LoadInt64(&job.Skipped),
+		Failed:   atomic.LoadInt64(&job.Failed),
+		Errors:   append([]string{}, job.Errors...),
+	}
+}
+
+func (job *Job) addError(page string, err error) {
+	atomic.AddInt64(&job.Failed, 1)
+	slog.Warn("Warm-up failed", "page", page, "error", err)
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if len(job.Errors) < maxJobErrors {
+		job.Errors = append(job.Errors, page+": "+err.Error())
+	}
+}
+
+func (job *Job) finish(status string) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.Status = status
+	job.Finished = time.Now()
+}
+
+// Fetches the sitemap and renders the og:image of each page that points at this server
+func (job *Job) Run(ctx context.Context, render RenderFunc) error {
+	slog.Info("Starting warm-up", "sitemap", job.Options.Sitemap)
+	pages, err := FetchSitemap(job.Options.Sitemap)
+	if err != nil {
+		job.mu.Lock()
+		job.Errors = append(job.Errors, err.Error())
+		job.mu.Unlock()
+		job.finish(StatusFailed)
+		slog.Error("Warm-up failed", "sitemap", job.Options.Sitemap, "error", err)
+		return err
+	}
+	atomic.StoreInt64(&job.Total, int64(len(pages)))
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < job.Options.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for page := range queue {
+				job.warmPage(page, render)
+				done := atomic.AddInt64(&job.Done, 1)
+				slog.Info("Warm-up progress", "done", done, "total", len(pages), "page", page)
+			}
+		}()
+	}
+	for _, page := range pages {
+		if ctx.Err() != nil {
+			break
+		}
+		queue <- page
+	}
+	close(queue)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		job.finish(StatusFailed)
+		return ctx.Err()
+	}
+	job.finish(StatusFinished)
+	snapshot := job.Snapshot()
+	slog.Info("Finished warm-up", "sitemap", job.Options.Sitemap, "rendered", snapshot.Rendered, "skipped", snapshot.Skipped, "failed", snapshot.Failed)
+	return nil
+}
+
+// renders the og:image of a page if it points at this server
+func (job *Job) warmPage(page string, render RenderFunc) {
+	ogImageURL, err := fetchOgImageURL(page)
+	if err != nil {
+		job.addError(page, err)
+		return
+	}
+	if ogImageURL == nil || ogImageURL.Host != job.Options.Host {
+		slog.Debug("Warm-up skipped page without og:image on this server", "page", page)
+		atomic.AddInt64(&job.Skipped, 1)
+		return
+	}
+	rendered, err := render(ogImageURL)
+	if err != nil {
+		job.addError(page, err)
+		return
+	}
+	if rendered {
+		atomic.AddInt64(&job.Rendered, 1)
+	} else {
+		atomic.AddInt64(&job.Skipped, 1)
+	}
+}
+
+// fetches a page and returns its og:image url resolved against the page url.
+// returns nil if the page has no og:image.
+func fetchOgImageURL(page string) (*url.URL, error) {
+	resp, err := scraper.GetClient().Get(page)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	doc, err := html.Parse(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	ogImage := scraper.FindOgUrl(doc)
+	if ogImage == "" {
+		return nil, nil
+	}
+	pageURL, _ := url.Parse(page)
+	return pageURL.Parse(ogImage)
+}
+
+// xml for both <urlset> and <sitemapindex> documents
+type sitemapDoc struct {
+	XMLName  xml.Name
+	URLs     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+// Fetches a sitemap and returns the page urls it contains,
+// following sitemap indexes
+func FetchSitemap(sitemapURL string) ([]string, error) {
+	var pages []string
+	seen := make(map[string]bool)
+	err := fetchSitemap(sitemapURL, 0, seen, &pages)
+	return pages, err
+}
+
+func fetchSitemap(sitemapURL string, depth int, seen map[string]bool, pages *[]string) error {
+	if depth > maxSitemapDepth {
+		return fmt.Errorf("%s: sitemap index nested too deeply", sitemapURL)
+	}
+	if seen[sitemapURL] {
+		return nil
+	}
+	seen[sitemapURL] = true
+
+	resp, err := scraper.GetClient().Get(sitemapURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status %d", sitemapURL, resp.StatusCode)
+	}
+	var body io.Reader = resp.Body
+	if strings.HasSuffix(sitemapURL, ".gz") {
+		if body, err = gzip.NewReader(resp.Body); err != nil {
+			return fmt.Errorf("%s: %w", sitemapURL, err)
+		}
+	}
+
+	var doc sitemapDoc
+	if err := xml.NewDecoder(body).Decode(&doc); err != nil {
+		return fmt.Errorf("%s: %w", sitemapURL, err)
+	}
+	switch doc.XMLName.Local {
+	case "urlset":
+		for _, u := range doc.URLs {
+			if len(*pages) >= maxPages {
+				return nil
+			}
+			if loc := strings.TrimSpace(u.Loc); loc != "" && !seen[loc] {
+				seen[loc] = true
+				*pages = append(*pages, loc)
+			}
+		}
+	case "sitemapindex":
+		for _, s := range doc.Sitemaps {
+			if loc := strings.TrimSpace(s.Loc); loc != "" {
+				if err := fetchSitemap(loc, depth+1, seen, pages); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		return errors.New(sitemapURL + ": not a sitemap")
+	}
+	return nil
+}
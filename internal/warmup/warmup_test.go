@@ -0,0 +1,114 @@
+package warmup_test
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/henrygd/social-image-server/internal/warmup"
+	"github.com/stretchr/testify/assert"
+)
+
+func createSiteServer() *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sitemap.xml":
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+				<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+					<sitemap><loc>%[1]s/sitemap-pages.xml</loc></sitemap>
+					<sitemap><loc>%[1]s/sitemap-posts.xml.gz</loc></sitemap>
+				</sitemapindex>`, server.URL)
+		case "/sitemap-pages.xml":
+			fmt.Fprintf(w, `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+					<url><loc>%[1]s/</loc></url>
+					<url><loc>%[1]s/about</loc></url>
+					<url><loc>%[1]s/about</loc></url>
+				</urlset>`, server.URL)
+		case "/sitemap-posts.xml.gz":
+			gz := gzip.NewWriter(w)
+			fmt.Fprintf(gz, `<urlset><url><loc>%[1]s/posts/1</loc></url><url><loc>%[1]s/missing</loc></url></urlset>`, server.URL)
+			gz.Close()
+		case "/", "/posts/1":
+			fmt.Fprintf(w, `<html><head><meta property="og:image" content="https://og.example.com/capture?url=%s%s"></head></html>`, server.URL, r.URL.Path)
+		case "/about":
+			// og:image on another server
+			fmt.Fprint(w, `<html><head><meta property="og:image" content="https://cdn.example.com/about.png"></head></html>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return server
+}
+
+func TestFetchSitemap(t *testing.T) {
+	server := createSiteServer()
+	defer server.Close()
+
+	pages, err := warmup.FetchSitemap(server.URL + "/sitemap.xml")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{server.URL + "/", server.URL + "/about", server.URL + "/posts/1", server.URL + "/missing"}, pages)
+
+	_, err = warmup.FetchSitemap(server.URL + "/nope.xml")
+	assert.ErrorContains(t, err, "status 404")
+
+	_, err = warmup.FetchSitemap(server.URL + "/about")
+	assert.Error(t, err)
+}
+
+func TestRun(t *testing.T) {
+	server := createSiteServer()
+	defer server.Close()
+
+	var rendered []string
+	var mu sync.Mutex
+	render := func(ogImageURL *url.URL) (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		rendered = append(rendered, ogImageURL.Query().Get("url"))
+		// pretend the post is already cached
+		return ogImageURL.Query().Get("url") != server.URL+"/posts/1", nil
+	}
+
+	job := warmup.New(warmup.Options{Sitemap: server.URL + "/sitemap.xml", Host: "og.example.com", Concurrency: 3})
+	assert.NoError(t, job.Run(context.Background(), render))
+
+	snapshot := job.Snapshot()
+	assert.Equal(t, warmup.StatusFinished, snapshot.Status)
+	assert.Equal(t, int64(4), snapshot.Total)
+	assert.Equal(t, int64(4), snapshot.Done)
+	assert.Equal(t, int64(1), snapshot.Rendered)
+	// about points at another server and post is cached
+	assert.Equal(t, int64(2), snapshot.Skipped)
+	// missing page returns 404
+	assert.Equal(t, int64(1), snapshot.Failed)
+	assert.Len(t, snapshot.Errors, 1)
+	assert.ElementsMatch(t, []string{server.URL + "/", server.URL + "/posts/1"}, rendered)
+}
+
+func TestStartAndGet(t *testing.T) {
+	server := createSiteServer()
+	defer server.Close()
+
+	render := func(ogImageURL *url.URL) (bool, error) {
+		return false, errors.New("render failed")
+	}
+	job := warmup.Start(warmup.Options{Sitemap: server.URL + "/sitemap-pages.xml", Host: "og.example.com"}, render)
+	assert.Equal(t, job, warmup.Get(job.ID))
+	assert.Nil(t, warmup.Get("nope"))
+
+	assert.Eventually(t, func() bool {
+		return job.Snapshot().Status == warmup.StatusFinished
+	}, 5*time.Second, 10*time.Millisecond)
+	snapshot := job.Snapshot()
+	assert.Equal(t, int64(1), snapshot.Failed)
+	assert.Equal(t, []string{server.URL + "/: render failed"}, snapshot.Errors)
+	assert.Len(t, warmup.List(), 1)
+}
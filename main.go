@@ -4,21 +4,27 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/henrygd/social-image-server/internal/browsercontext"
 	"github.com/henrygd/social-image-server/internal/concurrency"
+	"github.com/henrygd/social-image-server/internal/config"
 	"github.com/henrygd/social-image-server/internal/database"
 	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/henrygd/social-image-server/internal/jobs"
+	"github.com/henrygd/social-image-server/internal/profile"
 	"github.com/henrygd/social-image-server/internal/scraper"
 	"github.com/henrygd/social-image-server/internal/screenshot"
+	"github.com/henrygd/social-image-server/internal/storage"
 	"github.com/henrygd/social-image-server/internal/templates"
 	"github.com/henrygd/social-image-server/internal/update"
 	"golang.org/x/net/html"
@@ -26,10 +32,17 @@ import (
 
 var version = "0.1.0"
 
+var errInvalidTemplate = errors.New("Invalid template")
+var errTemplateNotAllowed = errors.New("Template not allowed for domain")
+
+// path to config file set by -config flag
+var configFile string
+
 func main() {
 	// handle flags
 	flagVersion := flag.Bool("v", false, "Print version")
 	flagUpdate := flag.Bool("update", false, "Update to latest version")
+	flag.StringVar(&configFile, "config", os.Getenv("CONFIG_FILE"), "Path to yaml config file")
 	flag.Parse()
 
 	if *flagVersion {
@@ -42,15 +55,10 @@ func main() {
 		os.Exit(0)
 	}
 
-	if logLevel := os.Getenv("LOG_LEVEL"); logLevel != "" {
-		switch logLevel {
-		case "debug":
-			slog.SetLogLoggerLevel(slog.LevelDebug)
-		case "warn":
-			slog.SetLogLoggerLevel(slog.LevelWarn)
-		case "error":
-			slog.SetLogLoggerLevel(slog.LevelError)
-		}
+	// handle subcommands
+	if args := flag.Args(); len(args) > 0 {
+		runCommand(args)
+		os.Exit(0)
 	}
 
 	slog.Info("Social Image Server", "v", version)
@@ -60,11 +68,11 @@ func main() {
 	// start cleanup routine
 	go cleanup()
 
+	// reload config on SIGHUP
+	go watchReload()
+
 	// start server
-	port, ok := os.LookupEnv("PORT")
-	if !ok {
-		port = "8080"
-	}
+	port := config.Get().Port
 	slog.Info("Starting server", "port", port)
 	if err := http.ListenAndServe(":"+port, router); err != nil {
 		log.Fatal(err)
@@ -72,22 +80,7 @@ func main() {
 }
 
 func setUpRouter() *http.ServeMux {
-	global.Init()
-	database.Init()
-	browsercontext.Init()
-
-	// create map of allowed allowedDomains for quick lookup
-	if allowedDomains, ok := os.LookupEnv("ALLOWED_DOMAINS"); ok {
-		slog.Debug("ALLOWED_DOMAINS", "value", allowedDomains)
-		domains := strings.Split(allowedDomains, ",")
-		global.AllowedDomainsMap = make(map[string]bool, len(domains))
-		for _, domain := range domains {
-			domain = strings.TrimSpace(domain)
-			if domain != "" {
-				global.AllowedDomainsMap[domain] = true
-			}
-		}
-	}
+	initServices()
 
 	router := http.NewServeMux()
 
@@ -98,6 +91,17 @@ func setUpRouter() *http.ServeMux {
 	// get is previous name for capture route - leaving for compatibility
 	router.HandleFunc("/get", handleImageRequest)
 
+	// authenticated admin api
+	addAdminRoutes(router)
+
+	// authenticated async render jobs
+	router.HandleFunc("POST /jobs", requireAdmin(handleCreateJob))
+	router.HandleFunc("GET /jobs/{id}", requireAdmin(handleGetJob))
+	jobs.Start(config.Get().JobWorkers, config.Get().WebhookSecret, func(imageURL *url.URL, force bool) error {
+		_, err := renderImageURL(imageURL, force)
+		return err
+	})
+
 	// help redirects to github readme
 	router.HandleFunc("/help", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "https://github.com/henrygd/social-image-server/blob/main/readme.md", http.StatusFound)
@@ -106,28 +110,96 @@ func setUpRouter() *http.ServeMux {
 	return router
 }
 
-func handleImageRequest(w http.ResponseWriter, r *http.Request) {
-	var err error
-	var reqData global.ReqData
+// loads config and initializes packages used to generate images
+func initServices() {
+	cfg := initData()
+	profile.Set(cfg.Profiles)
+	setImageProxy(cfg)
+	browsercontext.Init(cfg)
+}
 
-	// if template, check that template directory exists
-	if reqData.Template = r.PathValue("templateName"); reqData.Template != "" {
-		if !templates.IsValid(reqData.Template) {
-			http.Error(w, "Invalid template", http.StatusBadRequest)
-			return
+// sets up config, storage and the database without the browser
+func initData() *config.Config {
+	cfg := loadConfig()
+	config.Set(cfg)
+	setLogLevel(cfg.LogLevel)
+
+	global.Init(cfg)
+	storage.Init(cfg)
+	database.Init(cfg)
+	return cfg
+}
+
+// loads and validates config, exiting if there are any errors
+func loadConfig() *config.Config {
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		slog.Error("Invalid configuration", "file", configFile)
+		for _, line := range strings.Split(err.Error(), "\n") {
+			slog.Error(line)
+		}
+		os.Exit(1)
+	}
+	return cfg
+}
+
+// reloads settings that can change safely when receiving SIGHUP
+func watchReload() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	for range sigChan {
+		slog.Info("Reloading configuration", "file", configFile)
+		// pick up changes to templates edited in place
+		templates.Refresh()
+		next, err := config.Load(configFile)
+		if err != nil {
+			slog.Error("Configuration not reloaded", "error", err)
+			continue
+		}
+		cfg, restartRequired := config.Get().Reload(next)
+		for _, setting := range restartRequired {
+			slog.Warn("Setting changed but requires restart", "setting", setting)
 		}
+		config.Set(cfg)
+		setLogLevel(cfg.LogLevel)
+		global.SetAllowedDomains(cfg.AllowedDomains)
+		cacheTime, _ := config.ParseCacheTime(cfg.CacheTime)
+		database.SetCacheTime(cacheTime)
+		maxSize, _ := config.ParseSize(cfg.CacheMaxSize)
+		database.SetCacheLimits(maxSize, cfg.CacheMaxEntries)
+		profile.Set(cfg.Profiles)
+		setImageProxy(cfg)
 	}
+}
 
-	// get url query params
-	reqData.Params = r.URL.Query()
+func setImageProxy(cfg *config.Config) {
+	maxSize, _ := config.ParseSize(cfg.ImageProxyMaxSize)
+	templates.SetImageProxy(cfg.ImageProxy, cfg.ImageProxyDomains, maxSize)
+}
 
-	reqData.ValidatedURL, err = validateUrl(reqData.Params.Get("url"))
+func setLogLevel(logLevel string) {
+	switch logLevel {
+	case "debug":
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	case "warn":
+		slog.SetLogLoggerLevel(slog.LevelWarn)
+	case "error":
+		slog.SetLogLoggerLevel(slog.LevelError)
+	default:
+		slog.SetLogLoggerLevel(slog.LevelInfo)
+	}
+}
+
+func handleImageRequest(w http.ResponseWriter, r *http.Request) {
+	reqData, err := newReqData(r.PathValue("templateName"), r.URL.Query())
+	if errors.Is(err, templates.ErrInvalidManifest) {
+		handleServerError(w, err)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		handleError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	// key for url in database / mutexes
-	reqData.UrlKey = strings.TrimSuffix(reqData.ValidatedURL, "/")
 	// lock the mutex associated with the url
 	mutex := concurrency.GetOrCreateUrlMutex(reqData.UrlKey)
 	mutex.Lock()
@@ -146,8 +218,10 @@ func handleImageRequest(w http.ResponseWriter, r *http.Request) {
 			// 	return
 			// }
 		}
-		if filepath, err := screenshot.Take(&reqData); err == nil {
-			serveImage(w, r, filepath, "MISS", "1")
+		if img, err := screenshot.Take(reqData); err == nil {
+			if err := serveImage(w, r, img, "MISS", "1"); err != nil {
+				handleServerError(w, err)
+			}
 		} else {
 			handleServerError(w, err)
 		}
@@ -158,17 +232,32 @@ func handleImageRequest(w http.ResponseWriter, r *http.Request) {
 	// var cachedImage database.TemplateImage
 	cachedImage, _ := database.GetImage(reqData.UrlKey)
 
+	// treat image as not cached if past its own expiry time. only requests
+	// for the cached image can get it stale, others are checked against origin.
+	if cachedImage.File != "" && cachedImage.Expired() {
+		slog.Debug("Cached image expired", "url", reqData.ValidatedURL, "expires", cachedImage.Expires)
+		if cachedImage.CacheKey == reqData.CacheKey && serveStaleImage(w, r, reqData, cachedImage, "4") {
+			return
+		}
+		cachedImage = &database.Image{}
+	}
+
 	// has cached image and request url matches cache key for url - return cached image
 	if cachedImage.File != "" && cachedImage.CacheKey == reqData.CacheKey {
 		slog.Debug("Found cached image", "url", reqData.ValidatedURL, "cache_key", cachedImage.CacheKey)
-		serveImage(w, r, filepath.Join(global.ImageDir, cachedImage.File), "HIT", "2")
-		return
+		if serveCachedImage(w, r, cachedImage, "2") {
+			return
+		}
+		// missing file is treated as not cached
+		cachedImage = &database.Image{}
 	}
 
 	// check origin url before using browser
 	ok, originOgURL := checkUrlOk(reqData.ValidatedURL)
 	if !ok {
-		http.Error(w, "Could not connect to origin URL", http.StatusBadGateway)
+		if !serveFallback(w, r, reqData, "5", http.StatusBadGateway, "Could not connect to origin URL") {
+			handleError(w, "Could not connect to origin URL", http.StatusBadGateway)
+		}
 		return
 	}
 
@@ -176,7 +265,14 @@ func handleImageRequest(w http.ResponseWriter, r *http.Request) {
 	originCacheKey := makeCacheKey(originOgURL)
 	if cachedImage.File != "" && reqData.CacheKey != originCacheKey {
 		slog.Debug("Request image does not match origin", "req", reqData.CacheKey, "origin", originCacheKey)
-		serveImage(w, r, global.ImageDir+cachedImage.File, "HIT", "3")
+		if serveCachedImage(w, r, cachedImage, "3") {
+			return
+		}
+		cachedImage = &database.Image{}
+	}
+
+	// origin updated - serve the old image while the new one renders
+	if cachedImage.File != "" && serveStaleImage(w, r, reqData, cachedImage, "7") {
 		return
 	}
 
@@ -184,33 +280,310 @@ func handleImageRequest(w http.ResponseWriter, r *http.Request) {
 	// should only get here if:
 	// 1. url is not cached at all
 	// 2. origin og url matches request (origin updated, our db is stale)
-	if filepath, err := screenshot.Take(&reqData); err == nil {
-		serveImage(w, r, filepath, "MISS", "0")
-	} else {
+	img, err := screenshot.Take(reqData)
+	if err != nil {
+		slog.Error("Error generating image", "url", reqData.ValidatedURL, "error", err)
+		if !serveFallback(w, r, reqData, "6", http.StatusInternalServerError, "Could not generate image") {
+			handleError(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := serveImage(w, r, img, "MISS", "0"); err != nil {
 		handleServerError(w, err)
 	}
 }
 
+// Creates request data from the template name (empty for capture) and url query params.
+//
+// Returns an error if the template or url is not valid.
+func newReqData(template string, params url.Values) (*global.ReqData, error) {
+	reqData := &global.ReqData{Template: template, Params: params}
+
+	// if template, check that template directory exists
+	if reqData.Template != "" && !templates.IsValid(reqData.Template) {
+		return nil, errInvalidTemplate
+	}
+
+	var err error
+	reqData.ValidatedURL, err = validateUrl(reqData.Params.Get("url"))
+	if err != nil {
+		return nil, err
+	}
+	// resolve domain profile and check that it allows the template
+	if validatedUrl, err := url.Parse(reqData.ValidatedURL); err == nil {
+		reqData.Profile = profile.Get(validatedUrl.Host)
+	}
+	if base, _ := templates.SplitName(reqData.Template); base != "" && !reqData.Profile.AllowsTemplate(base) {
+		return nil, errTemplateNotAllowed
+	}
+	// validate params against the template manifest and apply defaults
+	if reqData.Template != "" {
+		manifest, err := templates.LoadManifest(reqData.Template)
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %w", reqData.Template, err)
+		}
+		if manifest != nil {
+			if reqData.Params, err = manifest.Apply(reqData.Params); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// key for url in database / mutexes
+	reqData.UrlKey = strings.TrimSuffix(reqData.ValidatedURL, "/")
+	return reqData, nil
+}
+
+// Recreates request data from a cache key created by makeCacheKey
+func reqDataFromCacheKey(cacheKey string) (*global.ReqData, error) {
+	template, query := cacheKeyTemplate(cacheKey, templates.List())
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	// versions replaced too many times ago are rendered with the current one,
+	// and stored under the key requests for the current version use
+	if base, _ := templates.SplitName(template); !templates.IsValid(template) && templates.IsValid(base) {
+		path := "/template/" + base
+		if strings.HasPrefix(cacheKey, template+"/") {
+			path += "/"
+		}
+		template = base
+		cacheKey = makeCacheKey(&url.URL{Path: path, RawQuery: query})
+	}
+	reqData, err := newReqData(template, params)
+	if err != nil {
+		return nil, err
+	}
+	reqData.CacheKey = cacheKey
+	return reqData, nil
+}
+
+// Splits a cache key created by makeCacheKey into the template name (empty
+// for capture) and query, matching the name against the template names.
+// The template name includes the version if the key has one.
+func cacheKeyTemplate(cacheKey string, names []string) (template, query string) {
+	template, query = "", cacheKey
+	if name, rest, ok := strings.Cut(cacheKey, "/"); ok {
+		// template requested with trailing slash (query is escaped so can't contain a slash)
+		return name, rest
+	}
+	// template requested without trailing slash has name directly before query
+	for _, name := range names {
+		rest, ok := strings.CutPrefix(cacheKey, name)
+		if !ok || len(name) <= len(template) {
+			continue
+		}
+		version := ""
+		if len(rest) > templates.VersionLength && rest[0] == '@' {
+			version, rest = rest[:templates.VersionLength+1], rest[templates.VersionLength+1:]
+		}
+		if params, err := url.ParseQuery(rest); err == nil && params.Has("url") {
+			template, query = name+version, rest
+		}
+	}
+	return template, query
+}
+
+// Creates request data from an og:image url pointing at this server
+func reqDataFromImageURL(imageURL *url.URL) (*global.ReqData, error) {
+	var template string
+	switch {
+	case imageURL.Path == "/capture" || imageURL.Path == "/get":
+	case strings.HasPrefix(imageURL.Path, "/template/"):
+		template = strings.Trim(strings.TrimPrefix(imageURL.Path, "/template/"), "/")
+	default:
+		return nil, errors.New("not an image url: " + imageURL.Path)
+	}
+	reqData, err := newReqData(template, imageURL.Query())
+	if err != nil {
+		return nil, err
+	}
+	reqData.CacheKey = makeCacheKey(imageURL)
+	return reqData, nil
+}
+
+// Renders the image for an og:image url pointing at this server, unless it's already cached.
+// Returns true if a new image was rendered.
+func renderImageURL(imageURL *url.URL, force bool) (rendered bool, err error) {
+	reqData, err := reqDataFromImageURL(imageURL)
+	if err != nil {
+		return false, err
+	}
+
+	mutex := concurrency.GetOrCreateUrlMutex(reqData.UrlKey)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !force {
+		if cachedImage, _ := database.GetImage(reqData.UrlKey); cachedImage.File != "" && cachedImage.CacheKey == reqData.CacheKey {
+			return false, nil
+		}
+	}
+	if _, err := screenshot.Take(reqData); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // cleans up old images and url mutexes, sleeps for an hour between cleaning cycles
 func cleanup() {
+	checkCache()
 	ticker := time.NewTicker(time.Hour)
-	//lint:ignore S1000 This loop is intentionally infinite and waits on ticker
+	fsckTicker := time.NewTicker(24 * time.Hour)
 	for {
 		select {
+		case <-fsckTicker.C:
+			checkCache()
 		case <-ticker.C:
 			if err := database.Clean(); err != nil {
 				slog.Error("Error cleaning database", "error", err)
 			}
 			concurrency.CleanUrlMutexes(time.Now())
+			templates.CleanProxyCache()
+			if err := database.CleanJobs("-7 days"); err != nil {
+				slog.Error("Error cleaning jobs", "error", err)
+			}
 		}
 	}
 }
 
-func serveImage(w http.ResponseWriter, r *http.Request, filename, status, code string) {
+// removes orphaned image files and rows whose file is missing
+func checkCache() {
+	if _, err := database.Fsck(false); err != nil {
+		slog.Error("Error checking cache consistency", "error", err)
+	}
+}
+
+// serves an image from storage. Returns fs.ErrNotExist without writing
+// a response if the image is missing.
+func serveImage(w http.ResponseWriter, r *http.Request, img *database.Image, status, code string) error {
+	// client or cdn already has this image
+	if img.Hash != "" && etagMatches(r.Header.Get("If-None-Match"), `"`+img.Hash+`"`) {
+		setImageHeaders(w, img, status, code)
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	// redirect to the bucket instead of proxying the image
+	if cfg := config.Get(); cfg.S3Redirect {
+		if presigner, ok := storage.Get().(storage.Presigner); ok {
+			if _, err := storage.Stat(img.File); errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			if signedURL, err := presigner.PresignGet(img.File, cfg.S3URLExpiry); err == nil {
+				setImageHeaders(w, img, status, code)
+				http.Redirect(w, r, signedURL, http.StatusFound)
+				return nil
+			}
+		}
+	}
+	f, info, err := storage.Open(img.File)
+	if errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err != nil {
+		handleServerError(w, err)
+		return nil
+	}
+	defer f.Close()
+	setImageHeaders(w, img, status, code)
+	http.ServeContent(w, r, img.File, info.ModTime, f)
+	return nil
+}
+
+// sets cache headers for an image response. status is HIT, MISS, STALE or FALLBACK.
+func setImageHeaders(w http.ResponseWriter, img *database.Image, status, code string) {
 	w.Header().Set("X-Og-Cache", status)
 	w.Header().Set("X-Og-Code", code)
-	// w.Header().Set("Cache-Control", "public, max-age=86400")
-	http.ServeFile(w, r, filename)
+	cfg := config.Get()
+	cacheControl := cfg.CacheControlHit
+	switch status {
+	case "MISS":
+		cacheControl = cfg.CacheControlMiss
+	case "STALE":
+		// caches must check back since a new image is on the way
+		cacheControl = "no-cache"
+	case "FALLBACK":
+		cacheControl = cfg.CacheControlError
+	}
+	if cacheControl != "" {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+	if img.Hash != "" {
+		w.Header().Set("ETag", `"`+img.Hash+`"`)
+	}
+}
+
+// returns true if the If-None-Match header matches the etag
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// serves a cached image. Returns false without writing a response if its file is missing.
+func serveCachedImage(w http.ResponseWriter, r *http.Request, img *database.Image, code string) bool {
+	if err := serveImage(w, r, img, "HIT", code); err != nil {
+		slog.Warn("Cached image file is missing", "url", img.Url, "file", img.File)
+		return false
+	}
+	touchImage(img.Url)
+	return true
+}
+
+// renders an image in the background. replaced in tests.
+var revalidateImage = screenshot.Render
+
+// serves an outdated cached image and regenerates it in the background if
+// SERVE_STALE is enabled. Returns false without writing a response otherwise.
+func serveStaleImage(w http.ResponseWriter, r *http.Request, reqData *global.ReqData, img *database.Image, code string) bool {
+	if !config.Get().ServeStale {
+		return false
+	}
+	if err := serveImage(w, r, img, "STALE", code); err != nil {
+		slog.Warn("Cached image file is missing", "url", img.Url, "file", img.File)
+		return false
+	}
+	if !concurrency.StartRevalidation(reqData.UrlKey) {
+		return true
+	}
+	// copy so the handler's request data isn't shared with the render
+	bgReqData := *reqData
+	go func() {
+		defer concurrency.FinishRevalidation(bgReqData.UrlKey)
+		slog.Debug("Regenerating stale image", "url", bgReqData.UrlKey)
+		// render without the url mutex so requests keep getting the stale image
+		buf, imageExtension, err := revalidateImage(&bgReqData)
+		if err != nil {
+			slog.Error("Error regenerating stale image", "url", bgReqData.UrlKey, "error", err)
+			return
+		}
+		mutex := concurrency.GetOrCreateUrlMutex(bgReqData.UrlKey)
+		mutex.Lock()
+		defer mutex.Unlock()
+		// _regen_, jobs or the admin api may have replaced the image meanwhile
+		if current, _ := database.GetImage(bgReqData.UrlKey); current.File != img.File {
+			slog.Debug("Stale image already replaced", "url", bgReqData.UrlKey)
+			return
+		}
+		if _, err := screenshot.Save(&bgReqData, buf, imageExtension); err != nil {
+			slog.Error("Error saving regenerated image", "url", bgReqData.UrlKey, "error", err)
+		}
+	}()
+	return true
+}
+
+// marks a cached image as recently served so it isn't evicted
+func touchImage(url string) {
+	if err := database.TouchImage(url); err != nil {
+		slog.Error("Error updating last access", "url", url, "error", err)
+	}
 }
 
 // checks url.Values to verify request is a valid regeneration request
@@ -234,7 +607,7 @@ func validateUrl(suppliedUrl string) (string, error) {
 		return "", errors.New("invalid url")
 	}
 	// check if host is in whitelist
-	if global.AllowedDomainsMap != nil && !global.AllowedDomainsMap[u.Host] {
+	if !global.IsAllowedDomain(u.Host) {
 		return "", errors.New("domain " + u.Host + " not allowed")
 	}
 
@@ -283,8 +656,31 @@ func makeCacheKey(input interface{}) string {
 	}
 	params := u.Query()
 	params.Del("_regen_")
+	// params the domain profile ignores don't change the image
+	if validatedUrl, err := validateUrl(params.Get("url")); err == nil {
+		if target, err := url.Parse(validatedUrl); err == nil {
+			params = profile.Get(target.Host).Filter(params)
+		}
+	}
 	if strings.HasPrefix(u.Path, "/template/") {
-		return strings.TrimPrefix(u.Path, "/template/") + params.Encode()
+		template := strings.TrimPrefix(u.Path, "/template/")
+		name, slash := strings.CutSuffix(template, "/")
+		if templates.IsValid(name) {
+			// images are regenerated when template files change
+			if _, version := templates.SplitName(name); version == "" {
+				if version, err := templates.Version(name); err == nil {
+					name += "@" + version
+				}
+			}
+			// params the template doesn't declare don't change the image
+			if manifest, _ := templates.LoadManifest(name); manifest != nil {
+				params = manifest.Filter(params)
+			}
+		}
+		if slash {
+			name += "/"
+		}
+		return name + params.Encode()
 	} else {
 		return params.Encode()
 	}
@@ -292,5 +688,14 @@ func makeCacheKey(input interface{}) string {
 
 func handleServerError(w http.ResponseWriter, err error) {
 	slog.Error("Error serving image", "error", err)
-	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	handleError(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
+// writes an error response with the error cache headers
+func handleError(w http.ResponseWriter, message string, code int) {
+	if cacheControl := config.Get().CacheControlError; cacheControl != "" {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+	w.Header().Del("ETag")
+	http.Error(w, message, code)
 }
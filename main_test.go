@@ -12,11 +12,15 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/henrygd/social-image-server/internal/concurrency"
 	"github.com/henrygd/social-image-server/internal/database"
 	"github.com/henrygd/social-image-server/internal/global"
+	"github.com/henrygd/social-image-server/internal/profile"
+	"github.com/henrygd/social-image-server/internal/templates"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -476,7 +480,7 @@ func TestTemplate(t *testing.T) {
 	// note on cache time - this test verifys that the cache time is working
 	// however, we only run database.Clean() once an hour, so functional min time is 1 hour
 	t.Run("CACHE_TIME", func(t *testing.T) {
-		defer os.Unsetenv("CACHE_TIME")
+		defer database.SetCacheTime(30 * 24 * time.Hour)
 		// with default cache time, clean should not delete any files
 		initialImageNum := filesInDir(global.ImageDir)
 		assert.Greater(t, initialImageNum, 0)
@@ -486,12 +490,12 @@ func TestTemplate(t *testing.T) {
 		// sleep for just over 1 second
 		time.Sleep(time.Millisecond * 1100)
 		// with cache time 5 seconds, there should still be files
-		os.Setenv("CACHE_TIME", "5 seconds")
+		database.SetCacheTime(5 * time.Second)
 		database.Clean()
 		imageNum = filesInDir(global.ImageDir)
 		assert.Greater(t, imageNum, 0)
 		// with cache time 1 second, the files should be cleaned up
-		os.Setenv("CACHE_TIME", "1 second")
+		database.SetCacheTime(time.Second)
 		database.Clean()
 		imageNum = filesInDir(global.ImageDir)
 		assert.Equal(t, imageNum, 0)
@@ -554,3 +558,311 @@ func filesInDir(dir string) int {
 	}
 	return len(files)
 }
+
+func TestMissingCachedFileIsMiss(t *testing.T) {
+	setUpRouter()
+	addTestImage(t, "https://missing.example.com/", "url=missing")
+	defer database.DeleteImages(database.ImageFilter{Domain: "missing.example.com"})
+	img, _ := database.GetImage("https://missing.example.com/")
+
+	rr := httptest.NewRecorder()
+	assert.True(t, serveCachedImage(rr, httptest.NewRequest("GET", "/", nil), img, "2"))
+	assert.Equal(t, "HIT", rr.Header().Get("X-Og-Cache"))
+
+	os.Remove(filepath.Join(global.ImageDir, img.File))
+	rr = httptest.NewRecorder()
+	assert.False(t, serveCachedImage(rr, httptest.NewRequest("GET", "/", nil), img, "2"))
+	// nothing is written so the request can continue as a miss
+	assert.Empty(t, rr.Header())
+	assert.Equal(t, 0, rr.Body.Len())
+}
+
+func TestCacheHeaders(t *testing.T) {
+	t.Setenv("CACHE_CONTROL_MISS", "public, max-age=60")
+	router := setUpRouter()
+	addTestImage(t, "https://headers.example.com/", "url=headers")
+	defer database.DeleteImages(database.ImageFilter{Domain: "headers.example.com"})
+	img, _ := database.GetImage("https://headers.example.com/")
+	img.Hash = "5d41402abc4b2a76b9719d911017c592"
+	etag := `"5d41402abc4b2a76b9719d911017c592"`
+
+	rr := httptest.NewRecorder()
+	serveImage(rr, httptest.NewRequest("GET", "/", nil), img, "HIT", "2")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, etag, rr.Header().Get("ETag"))
+	assert.Equal(t, "public, max-age=86400, stale-while-revalidate=604800", rr.Header().Get("Cache-Control"))
+
+	rr = httptest.NewRecorder()
+	serveImage(rr, httptest.NewRequest("GET", "/", nil), img, "MISS", "0")
+	assert.Equal(t, "public, max-age=60", rr.Header().Get("Cache-Control"))
+
+	for _, ifNoneMatch := range []string{etag, `"other", W/` + etag, "*"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("If-None-Match", ifNoneMatch)
+		rr = httptest.NewRecorder()
+		serveImage(rr, req, img, "HIT", "2")
+		assert.Equal(t, http.StatusNotModified, rr.Code, ifNoneMatch)
+		assert.Equal(t, etag, rr.Header().Get("ETag"))
+		assert.Equal(t, 0, rr.Body.Len())
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", `"other"`)
+	rr = httptest.NewRecorder()
+	serveImage(rr, req, img, "HIT", "2")
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// errors use the error cache control
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/capture", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "public, max-age=60", rr.Header().Get("Cache-Control"))
+}
+
+func TestServeStaleImage(t *testing.T) {
+	setUpRouter()
+	addTestImage(t, "https://stale.example.com/", "url=stale")
+	defer database.DeleteImages(database.ImageFilter{Domain: "stale.example.com"})
+	img, _ := database.GetImage("https://stale.example.com/")
+	reqData := &global.ReqData{ValidatedURL: img.Url, UrlKey: img.Url}
+
+	// disabled by default
+	rr := httptest.NewRecorder()
+	assert.False(t, serveStaleImage(rr, httptest.NewRequest("GET", "/", nil), reqData, img, "4"))
+	assert.Equal(t, 0, rr.Body.Len())
+
+	t.Setenv("SERVE_STALE", "true")
+	setUpRouter()
+	defer func(orig func(*global.ReqData) ([]byte, string, error)) { revalidateImage = orig }(revalidateImage)
+	calls := make(chan string, 2)
+	release := make(chan struct{})
+	revalidateImage = func(req *global.ReqData) ([]byte, string, error) {
+		calls <- req.UrlKey
+		<-release
+		return []byte("regenerated"), ".jpg", nil
+	}
+
+	for _, code := range []string{"4", "7"} {
+		rr = httptest.NewRecorder()
+		assert.True(t, serveStaleImage(rr, httptest.NewRequest("GET", "/", nil), reqData, img, code))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "STALE", rr.Header().Get("X-Og-Cache"))
+		assert.Equal(t, code, rr.Header().Get("X-Og-Code"))
+		assert.Equal(t, "no-cache", rr.Header().Get("Cache-Control"))
+	}
+	// only one render runs at a time for a url
+	assert.Equal(t, img.Url, <-calls)
+	close(release)
+	assert.Empty(t, calls)
+	// the row is swapped to the new image when it's saved
+	assert.Eventually(t, func() bool {
+		current, _ := database.GetImage(img.Url)
+		return current.File != img.File
+	}, 5*time.Second, 10*time.Millisecond)
+	current, _ := database.GetImage(img.Url)
+	data, _ := os.ReadFile(filepath.Join(global.ImageDir, current.File))
+	assert.Equal(t, "regenerated", string(data))
+	assert.NoFileExists(t, filepath.Join(global.ImageDir, img.File))
+
+	// images replaced during the render are kept
+	release = make(chan struct{})
+	assert.Eventually(t, func() bool { return concurrency.StartRevalidation(img.Url) }, 5*time.Second, 10*time.Millisecond)
+	concurrency.FinishRevalidation(img.Url)
+	assert.True(t, serveStaleImage(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), reqData, current, "4"))
+	<-calls
+	addTestImage(t, img.Url, "url=stale&_regen_")
+	replaced, _ := database.GetImage(img.Url)
+	close(release)
+	assert.Eventually(t, func() bool { return concurrency.StartRevalidation(img.Url) }, 5*time.Second, 10*time.Millisecond)
+	concurrency.FinishRevalidation(img.Url)
+	latest, _ := database.GetImage(img.Url)
+	assert.Equal(t, replaced.File, latest.File)
+}
+
+func TestExpiredImageStaleOnlyForCacheKey(t *testing.T) {
+	t.Setenv("SERVE_STALE", "true")
+	router := setUpRouter()
+	dir := filepath.Join(global.TemplateDir, "stale-card")
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+	os.WriteFile(filepath.Join(dir, "card.json"), []byte(`{"layers": [{"type": "text", "text": "{{title}}", "size": 64}]}`), 0644)
+	defer database.DeleteImages(database.ImageFilter{Prefix: mockServer.URL})
+
+	cachedURL, _ := url.Parse(fmt.Sprintf("/template/stale-card?url=%s&title=Cached", mockServer.URL))
+	addTestImage(t, mockServer.URL, makeCacheKey(cachedURL))
+	img, _ := database.GetImage(mockServer.URL)
+	img.Expires = database.ExpiresIn(-time.Hour)
+	database.AddImage(img)
+
+	// other params go through the origin check instead of replacing the stale image
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", fmt.Sprintf("/template/stale-card?url=%s&title=Other", mockServer.URL), nil))
+	assert.Equal(t, "MISS", rr.Header().Get("X-Og-Cache"))
+	assert.Equal(t, "0", rr.Header().Get("X-Og-Code"))
+}
+
+func TestServeFallback(t *testing.T) {
+	setUpRouter()
+	fallbackImage := filepath.Join(t.TempDir(), "fallback.png")
+	os.WriteFile(fallbackImage, []byte("fallback"), 0644)
+	reqData := &global.ReqData{
+		ValidatedURL: "https://fallback.example.com",
+		UrlKey:       "https://fallback.example.com",
+		Profile:      &profile.Profile{FallbackImage: fallbackImage},
+	}
+
+	// disabled by default
+	rr := httptest.NewRecorder()
+	assert.False(t, serveFallback(rr, httptest.NewRequest("GET", "/", nil), reqData, "5", http.StatusBadGateway, "down"))
+	assert.Empty(t, rr.Header())
+
+	t.Setenv("FALLBACK", "last,image")
+	setUpRouter()
+	rr = httptest.NewRecorder()
+	assert.True(t, serveFallback(rr, httptest.NewRequest("GET", "/", nil), reqData, "5", http.StatusBadGateway, "down"))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "FALLBACK", rr.Header().Get("X-Og-Cache"))
+	assert.Equal(t, "5", rr.Header().Get("X-Og-Code"))
+	assert.Equal(t, "image", rr.Header().Get("X-Og-Fallback"))
+	assert.Equal(t, "public, max-age=60", rr.Header().Get("Cache-Control"))
+	assert.Equal(t, "fallback", rr.Body.String())
+
+	// last image for the url is preferred, even if expired
+	addTestImage(t, reqData.UrlKey, "url=fallback")
+	defer database.DeleteImages(database.ImageFilter{Domain: "fallback.example.com"})
+	rr = httptest.NewRecorder()
+	assert.True(t, serveFallback(rr, httptest.NewRequest("GET", "/", nil), reqData, "6", http.StatusInternalServerError, "failed"))
+	assert.Equal(t, "last", rr.Header().Get("X-Og-Fallback"))
+	assert.Equal(t, "6", rr.Header().Get("X-Og-Code"))
+	assert.Equal(t, "public, max-age=60", rr.Header().Get("Cache-Control"))
+	assert.Equal(t, "not really a jpeg", rr.Body.String())
+
+	// fallbacks can't be revalidated as the real image
+	img, _ := database.GetImage(reqData.UrlKey)
+	img.Hash = "5d41402abc4b2a76b9719d911017c592"
+	database.AddImage(img)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", `"`+img.Hash+`"`)
+	rr = httptest.NewRecorder()
+	assert.True(t, serveFallback(rr, req, reqData, "6", http.StatusInternalServerError, "failed"))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("ETag"))
+	assert.Empty(t, rr.Header().Get("Last-Modified"))
+}
+
+func TestServeFallbackTemplate(t *testing.T) {
+	t.Setenv("FALLBACK", "template")
+	setUpRouter()
+	dir := filepath.Join(global.TemplateDir, fallbackTemplate)
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+	os.WriteFile(filepath.Join(dir, "card.json"), []byte(`{"layers": [{"type": "text", "text": "{{title}} {{error}}", "size": 64}]}`), 0644)
+	os.WriteFile(filepath.Join(dir, "template.json"), []byte(`{"params": {"title": {"required": true}}}`), 0644)
+	reqData := &global.ReqData{
+		ValidatedURL: "https://fallback.example.com",
+		UrlKey:       "https://fallback.example.com",
+		Params:       url.Values{"url": {"fallback.example.com"}},
+	}
+
+	// the fallback manifest is applied
+	rr := httptest.NewRecorder()
+	assert.False(t, serveFallback(rr, httptest.NewRequest("GET", "/", nil), reqData, "6", http.StatusInternalServerError, "failed"))
+	reqData.Params.Set("title", "Hello")
+	rr = httptest.NewRecorder()
+	assert.True(t, serveFallback(rr, httptest.NewRequest("GET", "/", nil), reqData, "6", http.StatusInternalServerError, "failed"))
+	assert.Equal(t, "template", rr.Header().Get("X-Og-Fallback"))
+	assert.Equal(t, "image/jpeg", rr.Header().Get("Content-Type"))
+	assert.Empty(t, rr.Header().Get("ETag"))
+
+	// and the profile has to allow it
+	reqData.Profile = &profile.Profile{Templates: []string{"blog"}}
+	rr = httptest.NewRecorder()
+	assert.False(t, serveFallback(rr, httptest.NewRequest("GET", "/", nil), reqData, "6", http.StatusInternalServerError, "failed"))
+}
+
+func TestTemplateErrorNotCached(t *testing.T) {
+	t.Setenv("FALLBACK", "template")
+	router := setUpRouter()
+	for name, files := range map[string]map[string]string{
+		// errors for some params only
+		"tmpl-error": {templates.IndexTemplate: `<h1>{{index .Values.tags 2}}</h1>`},
+		// edited after it was checked on upload
+		"svg-error":      {templates.SVGFile: `<svg viewBox="0 0 1200 630"><style>text { fill: {{color}} }</style></svg>`},
+		fallbackTemplate: {"card.json": `{"layers": [{"type": "text", "text": "{{error}}", "size": 64}]}`},
+	} {
+		dir := filepath.Join(global.TemplateDir, name)
+		os.MkdirAll(dir, 0755)
+		defer os.RemoveAll(dir)
+		for file, body := range files {
+			os.WriteFile(filepath.Join(dir, file), []byte(body), 0644)
+		}
+	}
+	defer database.DeleteImages(database.ImageFilter{Prefix: mockServer.URL})
+
+	// the template's error page isn't captured and cached as the image
+	for _, path := range []string{"/template/tmpl-error?tags=a&url=", "/template/svg-error?color=red&url="} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path+url.QueryEscape(mockServer.URL), nil))
+		assert.Equal(t, "FALLBACK", rr.Header().Get("X-Og-Cache"), path)
+		assert.Equal(t, "template", rr.Header().Get("X-Og-Fallback"), path)
+		_, err := database.GetImage(mockServer.URL)
+		assert.Error(t, err, path)
+	}
+}
+
+func TestTemplateManifest(t *testing.T) {
+	router := setUpRouter()
+	dir := filepath.Join(global.TemplateDir, "manifest-template")
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+	os.WriteFile(filepath.Join(dir, "template.json"), []byte(`{"params": {"title": {"required": true}, "theme": {"enum": ["light", "dark"]}}}`), 0644)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/template/manifest-template?theme=blue&url="+mockServer.URL, nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "Invalid template parameters:\n- theme must be one of [light dark]\n- title is required\n", rr.Body.String())
+
+	// undeclared params don't change the cache key
+	u, _ := url.Parse("/template/manifest-template?title=hello&utm_source=x&url=" + mockServer.URL)
+	version, _ := templates.Version("manifest-template")
+	assert.Equal(t, "manifest-template@"+version+url.Values{"title": {"hello"}, "url": {mockServer.URL}}.Encode(), makeCacheKey(u))
+
+	os.WriteFile(filepath.Join(dir, "template.json"), []byte(`{"format": "gif"}`), 0644)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/template/manifest-template?url="+mockServer.URL, nil))
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+}
+
+func TestCacheKeyIgnoresRestrictedParams(t *testing.T) {
+	setUpRouter()
+	host := strings.TrimPrefix(mockServer.URL, "http://")
+	profile.Set(map[string]*profile.Profile{host: {Overrides: []string{"dark"}}})
+	defer profile.Set(nil)
+
+	key := makeCacheKey("/capture?url=" + mockServer.URL + "&dark=true")
+	assert.Equal(t, key, makeCacheKey("/capture?url="+mockServer.URL+"&dark=true&width=2000&format=png"))
+	assert.NotEqual(t, key, makeCacheKey("/capture?url="+mockServer.URL))
+}
+
+func TestCardTemplate(t *testing.T) {
+	router := setUpRouter()
+	dir := filepath.Join(global.TemplateDir, "card-template")
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+	os.WriteFile(filepath.Join(dir, "card.json"), []byte(`{"layers": [
+		{"type": "rect", "color": "#0f172a"},
+		{"type": "text", "text": "{{title}}", "x": 60, "y": 60, "width": 1080, "height": 400, "size": 96, "min_size": 40, "color": "#fff"}
+	]}`), 0644)
+
+	// rendered without the browser
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", fmt.Sprintf("/template/card-template?url=%s&title=Hello&_regen_=%s", mockServer.URL, regenKey), nil))
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "image/jpeg", rr.Header().Get("Content-Type"))
+	img, err := jpeg.Decode(rr.Body)
+	if assert.NoError(t, err) {
+		assert.Equal(t, image.Rect(0, 0, 1000, 525), img.Bounds())
+	}
+	cached, _ := database.GetImage(mockServer.URL)
+	assert.Contains(t, cached.CacheKey, "card-template@")
+}